@@ -11,22 +11,35 @@ import (
 func TestAlgebraDataType(t *testing.T) {
 	mod := ir.NewModule()
 
-	typeExpr := mod.NewTypeDef("Expr", types.NewStruct(
-		types.I8,
-		types.NewArray(8, types.I8),
-	))
+	mod.DataLayout = X86_64.String()
+
 	typeExprInt := mod.NewTypeDef("EInt", types.NewStruct(
 		types.I8,
 		types.I32,
 	))
-	mod.NewTypeDef("EBool", types.NewStruct(
+	typeExprBool := mod.NewTypeDef("EBool", types.NewStruct(
 		types.I8,
 		types.I1,
 	))
-	mod.NewTypeDef("EString", types.NewStruct(
+	typeExprString := mod.NewTypeDef("EString", types.NewStruct(
 		types.I8,
 		types.NewPointer(types.I8),
 	))
+	// Expr is as large and as aligned as its largest variant, the payload
+	// after the tag is sized from the data layout instead of guessed
+	var size, align uint64
+	for _, variant := range []types.Type{typeExprInt, typeExprBool, typeExprString} {
+		if s := X86_64.SizeOf(variant); s > size {
+			size = s
+		}
+		if a := X86_64.AlignOf(variant); a > align {
+			align = a
+		}
+	}
+	typeExpr := mod.NewTypeDef("Expr", types.NewStruct(
+		types.I8,
+		types.NewArray(size-1, types.I8),
+	))
 
 	main := mod.NewFunc(
 		"main",
@@ -34,6 +47,7 @@ func TestAlgebraDataType(t *testing.T) {
 	)
 	b := main.NewBlock("")
 	exprInstance := b.NewAlloca(typeExpr)
+	exprInstance.Align = ir.Align(align)
 	exprTag := b.NewGetElementPtr(typeExpr, exprInstance, CI32(0), CI32(0))
 	// set tag to 0
 	b.NewStore(CI8(0), exprTag)
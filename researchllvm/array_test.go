@@ -23,10 +23,7 @@ func TestArray(t *testing.T) {
 	fmtStr := mod.NewGlobalDef("x", irutil.NewCString(formatString))
 	main := mod.NewFunc("main", types.I32)
 	mainB := main.NewBlock("")
-	ptrToStr := mainB.NewGetElementPtr(
-		types.NewArray(uint64(len(formatString)+1), types.I8), fmtStr,
-		CI32(0), CI32(0),
-	)
+	ptrToStr := PathOf(mainB, fmtStr).Index(CI32(0)).Addr()
 	arr := mainB.NewLoad(arrTy, arrayDef)
 	for i := 0; i < 5; i++ {
 		mainB.NewCall(printf, ptrToStr, CI32(int64(i)), mainB.NewExtractValue(arr, uint64(i)))
@@ -34,7 +31,7 @@ func TestArray(t *testing.T) {
 		mainB.NewCall(printf, ptrToStr, CI32(int64(i)), mainB.NewExtractValue(arr, uint64(i)))
 	}
 	for i := 0; i < 5; i++ {
-		pToElem := mainB.NewGetElementPtr(arrTy, arrayDef, CI32(0), CI32(int64(i)))
+		pToElem := PathOf(mainB, arrayDef).Index(CI32(int64(i))).Addr()
 		mainB.NewCall(printf, ptrToStr, CI32(int64(i)),
 			mainB.NewLoad(types.I8, pToElem))
 		mainB.NewStore(CI8(0), pToElem)
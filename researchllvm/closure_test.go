@@ -13,21 +13,20 @@ func TestClosure(t *testing.T) {
 	m := ir.NewModule()
 
 	zero := CI32(0)
-	one := CI32(1)
 	printf := PrintfPlugin(m)
 
-	captureStruct := m.NewTypeDef("id_capture", types.NewStruct(
-		types.I32,
-	))
-	captureTyp := types.NewPointer(captureStruct)
+	captureStruct := NewStruct(m, "id_capture",
+		Field{Name: "i", Typ: types.I32},
+	)
+	captureTyp := types.NewPointer(captureStruct.Typ)
 	idFn := m.NewFunc("id", types.I32, ir.NewParam("capture", captureTyp))
 	idB := idFn.NewBlock("")
-	v := idB.NewGetElementPtr(captureStruct, idFn.Params[0], zero, zero)
+	v := captureStruct.GEP(idB, idFn.Params[0], "i")
 	idB.NewRet(idB.NewLoad(types.I32, v))
-	idClosureTyp := m.NewTypeDef("id_closure", types.NewStruct(
-		captureTyp,
-		idFn.Type(),
-	))
+	idClosureTyp := NewStruct(m, "id_closure",
+		Field{Name: "env", Typ: captureTyp},
+		Field{Name: "fn", Typ: idFn.Type()},
+	)
 
 	mainFn := m.NewFunc("main", types.I32)
 	b := mainFn.NewBlock("")
@@ -35,19 +34,19 @@ func TestClosure(t *testing.T) {
 	i := b.NewAlloca(types.I32)
 	b.NewStore(CI32(10), i)
 	// use alloca at here to simplify code, in real case should be `malloc` or `gc_malloc`
-	captureInstance := b.NewAlloca(captureStruct)
-	ptrToCapture := b.NewGetElementPtr(captureStruct, captureInstance, zero, zero)
+	captureInstance := b.NewAlloca(captureStruct.Typ)
+	ptrToCapture := captureStruct.GEP(b, captureInstance, "i")
 	// capture variable
 	b.NewStore(b.NewLoad(types.I32, i), ptrToCapture)
 	// prepare closure
-	idClosure := b.NewAlloca(idClosureTyp)
-	ptrToCapturePtr := b.NewGetElementPtr(idClosureTyp, idClosure, zero, zero)
+	idClosure := b.NewAlloca(idClosureTyp.Typ)
+	ptrToCapturePtr := idClosureTyp.GEP(b, idClosure, "env")
 	b.NewStore(captureInstance, ptrToCapturePtr)
-	ptrToFuncPtr := b.NewGetElementPtr(idClosureTyp, idClosure, zero, one)
+	ptrToFuncPtr := idClosureTyp.GEP(b, idClosure, "fn")
 	b.NewStore(idFn, ptrToFuncPtr)
 	// assuming we transfer closure into another context
-	accessCapture := b.NewGetElementPtr(idClosureTyp, idClosure, zero, zero)
-	accessFunc := b.NewGetElementPtr(idClosureTyp, idClosure, zero, one)
+	accessCapture := idClosureTyp.GEP(b, idClosure, "env")
+	accessFunc := idClosureTyp.GEP(b, idClosure, "fn")
 	result := b.NewCall(b.NewLoad(idFn.Type(), accessFunc), b.NewLoad(captureTyp, accessCapture))
 
 	printIntegerFormat := m.NewGlobalDef("tmp", irutil.NewCString("%d\n"))
@@ -104,3 +103,42 @@ func TestClosure(t *testing.T) {
 // Output:
 //
 // 10
+
+func TestClosureABI(t *testing.T) {
+	m := ir.NewModule()
+	printf := PrintfPlugin(m)
+	format := m.NewGlobalDef("format", irutil.NewCString("%d %d\n"))
+
+	// a closure adding the captured i
+	env := NewStruct(m, "add_env", Field{Name: "i", Typ: types.I32})
+	add := m.NewFunc("add", types.I32, ir.NewParam("env", TPtr(TI8)), ir.NewParam("x", types.I32))
+	addB := add.NewBlock("")
+	captured := addB.NewBitCast(add.Params[0], TPtr(env.Typ))
+	i := addB.NewLoad(types.I32, env.GEP(addB, captured, "i"))
+	addB.NewRet(addB.NewAdd(add.Params[1], i))
+	// a plain function of the same signature, without environment
+	double := m.NewFunc("double", types.I32, ir.NewParam("x", types.I32))
+	doubleB := double.NewBlock("")
+	doubleB.NewRet(doubleB.NewMul(double.Params[0], CI32(2)))
+
+	mainFn := m.NewFunc("main", types.I32)
+	b := mainFn.NewBlock("")
+	// both go through the same slot
+	slot := b.NewAlloca(ClosureType(double.Sig))
+	envObj := b.NewAlloca(env.Typ)
+	b.NewStore(CI32(10), env.GEP(b, envObj, "i"))
+	b.NewStore(MakeClosure(b, envObj, add), slot)
+	r1 := CallClosure(b, b.NewLoad(slot.ElemType, slot), CI32(5))
+	b.NewStore(Thunk(double), slot)
+	r2 := CallClosure(b, b.NewLoad(slot.ElemType, slot), CI32(5))
+	b.NewCall(printf, PathOf(b, format).Index(CI32(0)).Addr(), r1, r2)
+	b.NewRet(CI32(0))
+
+	PrettyPrint(m)
+
+	ExecuteIR(m)
+}
+
+// Output:
+//
+// 15 10
@@ -0,0 +1,69 @@
+package controlflow
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/types"
+)
+
+func TestHoistAlloca(t *testing.T) {
+	f := ir.NewFunc("foo", types.Void)
+
+	err := CompileFunc(f, &SWhile{
+		Cond: &EBool{V: true},
+		Block: &SBlock{Stmts: []Stmt{
+			&SDefine{Name: "x", Typ: types.I32, Expr: &EI32{V: 1}},
+			// shadows the outer `x` with a slot of its own
+			&SBlock{Stmts: []Stmt{
+				&SDefine{Name: "x", Typ: types.I32, Expr: &EAdd{Lhs: &EVariable{Name: "x"}, Rhs: &EI32{V: 1}}},
+			}},
+			&SDefine{Name: "y", Typ: types.I32, Expr: &EVariable{Name: "x"}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Println(f.LLString())
+}
+
+// generated LLVM IR:
+//
+// ```
+// define void @foo() {
+// ; <label>:0
+// %x = alloca i32
+// %x.2 = alloca i32
+// %y = alloca i32
+// br label %while.loop.cond
+//
+// while.loop.cond:
+// br i1 true, label %while.loop.body, label %leave.while.loop
+//
+// while.loop.body:
+// %1 = bitcast i32* %x to i8*
+// call void @llvm.lifetime.start.p0i8(i64 -1, i8* %1)
+// store i32 1, i32* %x
+// %x.1 = load i32, i32* %x
+// %2 = add i32 %x.1, 1
+// %3 = bitcast i32* %x.2 to i8*
+// call void @llvm.lifetime.start.p0i8(i64 -1, i8* %3)
+// store i32 %2, i32* %x.2
+// %4 = bitcast i32* %x.2 to i8*
+// call void @llvm.lifetime.end.p0i8(i64 -1, i8* %4)
+// %x.3 = load i32, i32* %x
+// %5 = bitcast i32* %y to i8*
+// call void @llvm.lifetime.start.p0i8(i64 -1, i8* %5)
+// store i32 %x.3, i32* %y
+// %6 = bitcast i32* %y to i8*
+// call void @llvm.lifetime.end.p0i8(i64 -1, i8* %6)
+// %7 = bitcast i32* %x to i8*
+// call void @llvm.lifetime.end.p0i8(i64 -1, i8* %7)
+// br label %while.loop.cond
+//
+// leave.while.loop:
+// ret void
+// }
+// ```
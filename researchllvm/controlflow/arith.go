@@ -0,0 +1,209 @@
+package controlflow
+
+import (
+	"fmt"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/enum"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+	. "github.com/llir/researchllvm/helper"
+)
+
+type arithOp int
+
+const (
+	opAdd arithOp = iota
+	opSub
+	opMul
+	opDiv
+	opRem
+	opShl
+	opShr
+)
+
+// compileArith picks the integer or float instruction of op by the type of
+// the operands.
+func (ctx *Context) compileArith(op arithOp, lhs, rhs Expr, fastMath []enum.FastMathFlag) value.Value {
+	l, r := ctx.compileExpr(lhs), ctx.compileExpr(rhs)
+	if types.IsFloat(l.Type()) {
+		flags := ctx.fastMathFlags(fastMath)
+		switch op {
+		case opAdd:
+			inst := ctx.NewFAdd(l, r)
+			inst.FastMathFlags = flags
+			return inst
+		case opSub:
+			inst := ctx.NewFSub(l, r)
+			inst.FastMathFlags = flags
+			return inst
+		case opMul:
+			inst := ctx.NewFMul(l, r)
+			inst.FastMathFlags = flags
+			return inst
+		case opDiv:
+			inst := ctx.NewFDiv(l, r)
+			inst.FastMathFlags = flags
+			return inst
+		case opRem:
+			inst := ctx.NewFRem(l, r)
+			inst.FastMathFlags = flags
+			return inst
+		}
+	}
+	l, r = ctx.promote(l, r)
+	unsigned := IsUnsigned(l.Type())
+	switch op {
+	case opAdd:
+		return ctx.NewAdd(l, r)
+	case opSub:
+		return ctx.NewSub(l, r)
+	case opMul:
+		return ctx.NewMul(l, r)
+	case opDiv:
+		if unsigned {
+			return ctx.NewUDiv(l, r)
+		}
+		return ctx.NewSDiv(l, r)
+	case opRem:
+		if unsigned {
+			return ctx.NewURem(l, r)
+		}
+		return ctx.NewSRem(l, r)
+	case opShl:
+		return ctx.NewShl(l, r)
+	case opShr:
+		if unsigned {
+			return ctx.NewLShr(l, r)
+		}
+		return ctx.NewAShr(l, r)
+	}
+	panic("unknown arithmetic operator")
+}
+
+// promote brings two integers to their common type by the promotion rule of
+// the arithmetic expressions, other values are returned as they are.
+func (ctx *Context) promote(l, r value.Value) (value.Value, value.Value) {
+	lt, ok := l.Type().(*types.IntType)
+	if !ok {
+		return l, r
+	}
+	rt, ok := r.Type().(*types.IntType)
+	if !ok {
+		return l, r
+	}
+	switch {
+	case lt.BitSize < rt.BitSize:
+		return ctx.widen(l, rt), r
+	case lt.BitSize > rt.BitSize:
+		return l, ctx.widen(r, lt)
+	case lt != rt && IsUnsigned(rt):
+		// same width, the result is unsigned
+		return ctx.NewBitCast(l, rt), r
+	case lt != rt && IsUnsigned(lt):
+		return l, ctx.NewBitCast(r, lt)
+	}
+	return l, r
+}
+
+// widen extends the integer v to the wider integer type to by its signedness.
+func (ctx *Context) widen(v value.Value, to *types.IntType) value.Value {
+	if IsUnsigned(v.Type()) {
+		return ctx.NewZExt(v, to)
+	}
+	return ctx.NewSExt(v, to)
+}
+
+// coerce implicitly converts v to the type typ of the place it is stored to,
+// widening a narrower integer, and wrapping a function as a closure of the
+// same signature. Narrowing must be explicit with ETrunc. Other values are
+// returned as they are.
+func (ctx *Context) coerce(v value.Value, typ types.Type) value.Value {
+	if f, ok := v.(*ir.Func); ok && ClosureSig(typ) != nil {
+		return Thunk(f)
+	}
+	from, ok := v.Type().(*types.IntType)
+	if !ok {
+		return v
+	}
+	to, ok := typ.(*types.IntType)
+	if !ok || from == to {
+		return v
+	}
+	switch {
+	case from.BitSize < to.BitSize:
+		return ctx.widen(v, to)
+	case from.BitSize == to.BitSize:
+		// the same integer type with other signedness
+		return ctx.NewBitCast(v, to)
+	}
+	panic(fmt.Sprintf("cannot narrow %s to %s implicitly", from, to))
+}
+
+func (ctx *Context) fastMathFlags(flags []enum.FastMathFlag) []enum.FastMathFlag {
+	if flags != nil {
+		return flags
+	}
+	return ctx.fn.fastMath
+}
+
+func (ctx *Context) fcmp(pred enum.FPred, l, r value.Value, fastMath []enum.FastMathFlag) *ir.InstFCmp {
+	inst := ctx.NewFCmp(pred, l, r)
+	inst.FastMathFlags = ctx.fastMathFlags(fastMath)
+	return inst
+}
+
+// convert converts the number v to typ.
+func (ctx *Context) convert(v value.Value, typ types.Type) value.Value {
+	switch from := v.Type().(type) {
+	case *types.IntType:
+		switch to := typ.(type) {
+		case *types.IntType:
+			switch {
+			case from.BitSize < to.BitSize:
+				return ctx.widen(v, to)
+			case from.BitSize > to.BitSize:
+				return ctx.NewTrunc(v, to)
+			case from != to:
+				return ctx.NewBitCast(v, to)
+			}
+			return v
+		case *types.FloatType:
+			if IsUnsigned(from) {
+				return ctx.NewUIToFP(v, to)
+			}
+			return ctx.NewSIToFP(v, to)
+		}
+	case *types.FloatType:
+		switch to := typ.(type) {
+		case *types.IntType:
+			if IsUnsigned(to) {
+				return ctx.NewFPToUI(v, to)
+			}
+			return ctx.NewFPToSI(v, to)
+		case *types.FloatType:
+			switch {
+			case floatBitSize(from) < floatBitSize(to):
+				return ctx.NewFPExt(v, to)
+			case floatBitSize(from) > floatBitSize(to):
+				return ctx.NewFPTrunc(v, to)
+			}
+			return v
+		}
+	}
+	panic(fmt.Sprintf("cannot convert %s to %s", v.Type(), typ))
+}
+
+func floatBitSize(t *types.FloatType) uint64 {
+	switch t.Kind {
+	case types.FloatKindHalf:
+		return 16
+	case types.FloatKindFloat:
+		return 32
+	case types.FloatKindDouble:
+		return 64
+	case types.FloatKindX86_FP80:
+		return 80
+	}
+	return 128
+}
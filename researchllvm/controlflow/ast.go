@@ -22,27 +22,279 @@ type EBool struct {
 	EConstant
 	V bool
 }
+type EI8 struct {
+	EConstant
+	V int64
+}
+type EI16 struct {
+	EConstant
+	V int64
+}
 type EI32 struct {
 	EConstant
 	V int64
 }
+type EI64 struct {
+	EConstant
+	V int64
+}
+type EU8 struct {
+	EConstant
+	V uint64
+}
+type EU16 struct {
+	EConstant
+	V uint64
+}
+type EU32 struct {
+	EConstant
+	V uint64
+}
+type EU64 struct {
+	EConstant
+	V uint64
+}
+type EF32 struct {
+	EConstant
+	V float64
+}
+type EF64 struct {
+	EConstant
+	V float64
+}
 type EVariable struct {
 	Expr
 	Name string
 }
+
+// Arithmetic works on integers and floats. FastMath sets the fast-math flags
+// of a float operation, overriding those of the function.
+//
+// Integer operands of different types are promoted before the operation: the
+// narrower one is widened to the wider type, sign extended when it is signed,
+// zero extended when it is unsigned. The result has the wider type; operands
+// of the same width give an unsigned result when either is unsigned. Division,
+// remainder, shift right and comparisons are unsigned for unsigned results.
 type EAdd struct {
 	Expr
 	Lhs, Rhs Expr
+	FastMath []enum.FastMathFlag
+}
+type ESub struct {
+	Expr
+	Lhs, Rhs Expr
+	FastMath []enum.FastMathFlag
 }
+type EMul struct {
+	Expr
+	Lhs, Rhs Expr
+	FastMath []enum.FastMathFlag
+}
+type EDiv struct {
+	Expr
+	Lhs, Rhs Expr
+	FastMath []enum.FastMathFlag
+}
+type ERem struct {
+	Expr
+	Lhs, Rhs Expr
+	FastMath []enum.FastMathFlag
+}
+
+// Strings are values of the string runtime of the module, see
+// helper.StringRuntime. ELessThan compares strings as well.
+type EString struct {
+	Expr
+	V string
+}
+type EConcat struct {
+	Expr
+	Lhs, Rhs Expr
+}
+type ESubstr struct {
+	Expr
+	Str        Expr
+	Start, Len Expr
+}
+
+// EStrCmp is less than, equal to or greater than zero as Lhs is less than,
+// equal to or greater than Rhs.
+type EStrCmp struct {
+	Expr
+	Lhs, Rhs Expr
+}
+
+type EShl struct {
+	Expr
+	Lhs, Rhs Expr
+}
+type EShr struct {
+	Expr
+	Lhs, Rhs Expr
+}
+
+// ELessThan compares floats ordered, it is false when either side is NaN.
 type ELessThan struct {
 	Expr
 	Lhs, Rhs Expr
 }
 
+// EFCmp compares floats with any predicate, ordered or unordered.
+type EFCmp struct {
+	Expr
+	Pred     enum.FPred
+	Lhs, Rhs Expr
+	FastMath []enum.FastMathFlag
+}
+
+// EConvert converts a number to the type Typ, keeping its value as far as Typ
+// can represent it: between integers, integers and floats, floats of different
+// sizes.
+type EConvert struct {
+	Expr
+	X   Expr
+	Typ types.Type
+}
+
+// Explicit casts, which work on the bits of the value.
+type ETrunc struct {
+	Expr
+	X   Expr
+	Typ types.Type
+}
+type EZExt struct {
+	Expr
+	X   Expr
+	Typ types.Type
+}
+type ESExt struct {
+	Expr
+	X   Expr
+	Typ types.Type
+}
+type EPtrToInt struct {
+	Expr
+	X   Expr
+	Typ types.Type
+}
+
+// Pointers. EAddrOf takes the address of a place: a variable, a dereferenced
+// pointer or an indexed element. EIndex indexes an array, or the elements a
+// pointer points to.
+type EAddrOf struct {
+	Expr
+	X Expr
+}
+type EDeref struct {
+	Expr
+	X Expr
+}
+type EIndex struct {
+	Expr
+	X     Expr
+	Index Expr
+}
+
+// EGlobal is the address of a global of the module.
+type EGlobal struct {
+	Expr
+	G *ir.Global
+}
+
+// Structs are created by helper.NewStruct, their fields are referred to by
+// name. Fields missing from an EStructLit are zero. EField reaches through a
+// pointer to a struct as well.
+type EStructLit struct {
+	Expr
+	Typ    *Struct
+	Fields []FieldInit
+}
+type FieldInit struct {
+	Name string
+	Expr Expr
+}
+type EField struct {
+	Expr
+	X    Expr
+	Name string
+}
+
+// ENew allocates a zeroed Typ on the heap, or Len of them, and is a pointer to
+// it. The memory is managed by the collector of the function, see
+// WithCollector; without one, it is released with SFree.
+//
+// With GCRefCount, pointer variables and the pointer fields of structs that
+// ENew allocates hold references: a variable retains the object it is
+// assigned and releases it when it is reassigned or goes out of scope, a
+// store into a field of such an object retains and releases likewise, and the
+// object releases its fields when it is freed. ENew is a new reference, it is
+// not retained again. The elements of an array that ENew allocates with Len
+// are not references, neither are pointers from EAddrOf or EGlobal, which
+// cannot be assigned to a variable in this mode.
+type ENew struct {
+	Expr
+	Typ types.Type
+	Len Expr
+}
+
+// ELambda is an anonymous function. The variables of the enclosing function
+// that its body uses are captured by value when the lambda is evaluated,
+// except those named in ByRef, which the lambda shares with the enclosing
+// function and the other closures capturing them. The lambda is a closure,
+// `{ i8*, RetType (i8*, params...)* }`: an environment with the captured
+// values, and the function lifted out of the body, which takes the
+// environment as its first parameter.
+//
+// The environment lives in a stack slot of the enclosing function unless the
+// closure escapes it, see analyzeClosures. A variable captured by reference
+// then lives on the heap as well.
+type ELambda struct {
+	Expr
+	Params  []Param
+	RetType types.Type
+	Body    Stmt
+	ByRef   []string
+}
+type Param struct {
+	Name string
+	Typ  types.Type
+}
+
+// ECall calls a closure or a function.
+type ECall struct {
+	Expr
+	Callee Expr
+	Args   []Expr
+}
+
+// EFunc is a function of the module.
+type EFunc struct {
+	Expr
+	F *ir.Func
+}
+
 func compileConstant(e EConstant) constant.Constant {
 	switch e := e.(type) {
+	case *EI8:
+		return CI8(e.V)
+	case *EI16:
+		return CI16(e.V)
 	case *EI32:
 		return CI32(e.V)
+	case *EI64:
+		return CI64(e.V)
+	case *EU8:
+		return constant.NewInt(TU8, int64(e.V))
+	case *EU16:
+		return constant.NewInt(TU16, int64(e.V))
+	case *EU32:
+		return constant.NewInt(TU32, int64(e.V))
+	case *EU64:
+		return constant.NewInt(TU64, int64(e.V))
+	case *EF32:
+		return CF32(e.V)
+	case *EF64:
+		return CF64(e.V)
 	case *EBool:
 		if e.V {
 			return CI1(1)
@@ -58,13 +310,97 @@ func compileConstant(e EConstant) constant.Constant {
 func (ctx *Context) compileExpr(e Expr) value.Value {
 	switch e := e.(type) {
 	case *EVariable:
-		return ctx.lookupVariable(e.Name)
+		return ctx.readVariable(ctx.lookupVariable(e.Name))
 	case *EAdd:
+		return ctx.compileArith(opAdd, e.Lhs, e.Rhs, e.FastMath)
+	case *ESub:
+		return ctx.compileArith(opSub, e.Lhs, e.Rhs, e.FastMath)
+	case *EMul:
+		return ctx.compileArith(opMul, e.Lhs, e.Rhs, e.FastMath)
+	case *EDiv:
+		return ctx.compileArith(opDiv, e.Lhs, e.Rhs, e.FastMath)
+	case *ERem:
+		return ctx.compileArith(opRem, e.Lhs, e.Rhs, e.FastMath)
+	case *EShl:
+		return ctx.compileArith(opShl, e.Lhs, e.Rhs, nil)
+	case *EShr:
+		return ctx.compileArith(opShr, e.Lhs, e.Rhs, nil)
+	case *EString:
+		return ctx.fn.strings().Literal(e.V)
+	case *EConcat:
 		l, r := ctx.compileExpr(e.Lhs), ctx.compileExpr(e.Rhs)
-		return ctx.NewAdd(l, r)
+		return ctx.NewCall(ctx.fn.strings().Concat, l, r)
+	case *ESubstr:
+		str := ctx.compileExpr(e.Str)
+		start, length := ctx.compileExpr(e.Start), ctx.compileExpr(e.Len)
+		return ctx.NewCall(ctx.fn.strings().Substr, str, ctx.coerce(start, TI64), ctx.coerce(length, TI64))
+	case *EStrCmp:
+		l, r := ctx.compileExpr(e.Lhs), ctx.compileExpr(e.Rhs)
+		return ctx.NewCall(ctx.fn.strings().Compare, l, r)
 	case *ELessThan:
 		l, r := ctx.compileExpr(e.Lhs), ctx.compileExpr(e.Rhs)
+		if ctx.fn.isString(l.Type()) {
+			return ctx.NewICmp(enum.IPredSLT, ctx.NewCall(ctx.fn.strings().Compare, l, r), CI32(0))
+		}
+		if types.IsFloat(l.Type()) {
+			return ctx.fcmp(enum.FPredOLT, l, r, nil)
+		}
+		l, r = ctx.promote(l, r)
+		if IsUnsigned(l.Type()) {
+			return ctx.NewICmp(enum.IPredULT, l, r)
+		}
 		return ctx.NewICmp(enum.IPredSLT, l, r)
+	case *EFCmp:
+		l, r := ctx.compileExpr(e.Lhs), ctx.compileExpr(e.Rhs)
+		return ctx.fcmp(e.Pred, l, r, e.FastMath)
+	case *EConvert:
+		return ctx.convert(ctx.compileExpr(e.X), e.Typ)
+	case *ETrunc:
+		return ctx.NewTrunc(ctx.compileExpr(e.X), e.Typ)
+	case *EZExt:
+		return ctx.NewZExt(ctx.compileExpr(e.X), e.Typ)
+	case *ESExt:
+		return ctx.NewSExt(ctx.compileExpr(e.X), e.Typ)
+	case *EPtrToInt:
+		return ctx.NewPtrToInt(ctx.compileExpr(e.X), e.Typ)
+	case *EAddrOf:
+		return ctx.compileAddr(e.X)
+	case *EDeref:
+		ptr := ctx.compileExpr(e.X)
+		return ctx.NewLoad(elemType(ptr), ptr)
+	case *EIndex:
+		ptr, val := ctx.compileIndex(e)
+		if ptr != nil {
+			return ctx.NewLoad(elemType(ptr), ptr)
+		}
+		return val
+	case *EGlobal:
+		return e.G
+	case *EStructLit:
+		var v value.Value = constant.NewZeroInitializer(e.Typ.Typ)
+		for _, field := range e.Fields {
+			elem := ctx.coerce(ctx.compileExpr(field.Expr), e.Typ.FieldType(field.Name))
+			v = e.Typ.Insert(ctx.Block, v, elem, field.Name)
+		}
+		return v
+	case *ENew:
+		v := ctx.compileNew(e)
+		if ctx.fn.gc == GCRefCount {
+			ctx.fn.temps = append(ctx.fn.temps, v)
+		}
+		return v
+	case *ELambda:
+		return ctx.compileLambda(e)
+	case *ECall:
+		return ctx.compileCall(e)
+	case *EFunc:
+		return e.F
+	case *EField:
+		ptr, val := ctx.compileField(e)
+		if ptr != nil {
+			return ctx.NewLoad(elemType(ptr), ptr)
+		}
+		return val
 	case EConstant:
 		return compileConstant(e)
 	}
@@ -72,15 +408,39 @@ func (ctx *Context) compileExpr(e Expr) value.Value {
 }
 
 type Stmt interface{ isStmt() Stmt }
-type SBreak struct{ Stmt }
+
+// Pos is the position of a statement in the source file, the zero Pos is an
+// unknown position.
+type Pos struct{ Line, Col int64 }
+
+func (p Pos) pos() Pos { return p }
+
+func posOf(stmt Stmt) Pos {
+	if p, ok := stmt.(interface{ pos() Pos }); ok {
+		return p.pos()
+	}
+	return Pos{}
+}
+
+type SBlock struct {
+	Stmt
+	Pos
+	Stmts []Stmt
+}
+type SBreak struct {
+	Stmt
+	Pos
+}
 type SIf struct {
 	Stmt
+	Pos
 	Cond Expr
 	Then Stmt
 	Else Stmt
 }
 type SSwitch struct {
 	Stmt
+	Pos
 	Target   Expr
 	CaseList []struct {
 		EConstant
@@ -90,11 +450,13 @@ type SSwitch struct {
 }
 type SDoWhile struct {
 	Stmt
+	Pos
 	Cond  Expr
 	Block Stmt
 }
 type SForLoop struct {
 	Stmt
+	Pos
 	InitName string
 	InitExpr Expr
 	Step     Expr
@@ -103,32 +465,118 @@ type SForLoop struct {
 }
 type SWhile struct {
 	Stmt
+	Pos
 	Cond  Expr
 	Block Stmt
 }
 type SDefine struct {
 	Stmt
+	Pos
 	Name string
 	Typ  types.Type
 	Expr Expr
 }
+type SAssign struct {
+	Stmt
+	Pos
+	Name string
+	Expr Expr
+}
 type SRet struct {
 	Stmt
+	Pos
 	Val Expr
 }
 
+// SStore stores into the place Target refers to, `*p = v` or `a[i] = v`.
+type SStore struct {
+	Stmt
+	Pos
+	Target Expr
+	Expr   Expr
+}
+
+// SFree releases the memory of an ENew without collector.
+type SFree struct {
+	Stmt
+	Pos
+	Expr Expr
+}
+
+// SExpr evaluates an expression for its effects, a call for example.
+type SExpr struct {
+	Stmt
+	Pos
+	Expr Expr
+}
+
+// STry runs Body, and the first of Catches whose type matches an exception
+// thrown in it, by Body itself or by the functions it calls. An exception that
+// no catch matches is rethrown. Finally runs whenever the statement is left,
+// like an SDefer around it.
+type STry struct {
+	Stmt
+	Pos
+	Body    Stmt
+	Catches []Catch
+	Finally Stmt
+}
+
+// Catch catches the exceptions of type Typ, a catch-all when Typ is nil. The
+// exception is the variable Name in Body, unless Name is empty.
+type Catch struct {
+	Typ  types.Type
+	Name string
+	Body Stmt
+}
+
+// SDefer runs Body when the scope it is in is left: at its end, by break or
+// return, or by an exception that unwinds through it. The deferred statements
+// of a scope run last deferred first.
+type SDefer struct {
+	Stmt
+	Pos
+	Body Stmt
+}
+
+// SThrow throws the value of Expr as an exception of its type.
+type SThrow struct {
+	Stmt
+	Pos
+	Expr Expr
+}
+
+// SPrint prints a string to stdout.
+type SPrint struct {
+	Stmt
+	Pos
+	Expr Expr
+}
+
 type Context struct {
 	*extend.ExtBlock
 	parent     *Context
-	vars       map[string]value.Value
+	fn         *funcContext
+	vars       map[string]*variable
+	slots      []*ir.InstAlloca
 	leaveBlock *ir.Block
+	// owned are the reference counted variables of the scope
+	owned []*variable
+	// try is the try region that the scope is the body of
+	try *tryRegion
+	// cleanups run when the scope is left, see runCleanups
+	cleanups []func(ctx *Context)
+	// handlers are the cleanup handlers of the scope by what it had to
+	// leave when they were created, see cleanupHandler
+	handlers map[scopeSize]*handler
 }
 
 func NewContext(b *ir.Block) *Context {
 	return &Context{
 		ExtBlock:   extend.Block(b),
 		parent:     nil,
-		vars:       make(map[string]value.Value),
+		fn:         newFuncContext(b),
+		vars:       make(map[string]*variable),
 		leaveBlock: nil,
 	}
 }
@@ -136,10 +584,161 @@ func NewContext(b *ir.Block) *Context {
 func (c *Context) NewContext(b *ir.Block) *Context {
 	ctx := NewContext(b)
 	ctx.parent = c
+	ctx.fn = c.fn
 	return ctx
 }
 
-func (c Context) lookupVariable(name string) value.Value {
+// funcContext is the state shared by all contexts of one function.
+type funcContext struct {
+	next map[string]int
+	used map[string]bool
+	// entry block of the function, all stack slots are allocated at its start
+	entry   *ir.Block
+	allocas int
+	// ssa is non-nil when variables are SSA values instead of stack slots
+	ssa *ssaBuilder
+	// declarations of a function that does not belong to a module
+	decls map[string]*ir.Func
+	// debug is non-nil when debug info is emitted
+	debug    *debugInfo
+	fastMath []enum.FastMathFlag
+	stringRT *StringRuntime
+	gc       GCStrategy
+	// options the function is compiled with, lambdas are compiled with them
+	opts []Option
+	// addressTaken are the names of variables that keep their stack slot in
+	// SSA form, as their address is taken
+	addressTaken map[string]bool
+	closures     *closureInfo
+	// err is the first error of a lambda of the function
+	err error
+	// temps are the new objects of the statement being compiled that no
+	// variable or object holds, see releaseTemps
+	temps []value.Value
+	// unsealed are the blocks of exception handlers, sealed when the
+	// function is done
+	unsealed []*ir.Block
+	// lowering lowers the exceptions of the function with strategy
+	strategy EHStrategy
+	lowering ehLowering
+	// strategySet is set by WithExceptions
+	strategySet bool
+	// varsInMemory puts all variables in stack slots, even loop variables,
+	// which are loaded and stored volatile so that no pass promotes them
+	varsInMemory bool
+}
+
+func newFuncContext(entry *ir.Block) *funcContext {
+	return &funcContext{
+		next:  make(map[string]int),
+		used:  make(map[string]bool),
+		entry: entry,
+		decls: make(map[string]*ir.Func),
+		// no closures until compileFunc analyzes the body
+		closures: &closureInfo{},
+		lowering: &itaniumLowering{},
+	}
+}
+
+func (fc *funcContext) module() *ir.Module {
+	mod := fc.entry.Parent.Parent
+	if mod == nil {
+		panic("the function must belong to a module")
+	}
+	return mod
+}
+
+// strings returns the string runtime of the module, emitting it on first use.
+func (fc *funcContext) strings() *StringRuntime {
+	if fc.stringRT == nil {
+		fc.stringRT = StringPlugin(fc.module())
+	}
+	return fc.stringRT
+}
+
+func (fc *funcContext) isString(t types.Type) bool {
+	st, ok := t.(*types.StructType)
+	return ok && fc.entry.Parent.Parent != nil && st == fc.strings().Typ
+}
+
+// declare returns the function called name, declared in the module of the
+// compiled function. Without module, it is declared once outside any module.
+func (fc *funcContext) declare(name string, retType types.Type, params ...*ir.Param) *ir.Func {
+	if mod := fc.entry.Parent.Parent; mod != nil {
+		return Declare(mod, name, retType, params...)
+	}
+	if f, ok := fc.decls[name]; ok {
+		return f
+	}
+	f := ir.NewFunc(name, retType, params...)
+	fc.decls[name] = f
+	return f
+}
+
+// newName returns a local name based on base that is unique in the function,
+// `if.then`, `if.then.1`, `if.then.2` and so on. The empty name stays empty,
+// such values are numbered by llir.
+func (fc *funcContext) newName(base string) string {
+	if base == "" {
+		return ""
+	}
+	for {
+		n := fc.next[base]
+		fc.next[base] = n + 1
+		name := base
+		if n > 0 {
+			name = fmt.Sprintf("%s.%d", base, n)
+		}
+		if !fc.used[name] {
+			fc.used[name] = true
+			return name
+		}
+	}
+}
+
+func (ctx *Context) newBlock(name string) *ir.Block {
+	return ctx.Parent.NewBlock(ctx.fn.newName(name))
+}
+
+// newAlloca allocates a stack slot in the entry block, after the slots
+// allocated before it. The slot then exists once per call, not once per
+// execution of its definition, and mem2reg can promote it.
+func (ctx *Context) newAlloca(typ types.Type, name string) *ir.InstAlloca {
+	slot := ir.NewAlloca(typ)
+	slot.SetName(ctx.fn.newName(name))
+	entry, n := ctx.fn.entry, ctx.fn.allocas
+	entry.Insts = append(entry.Insts[:n], append([]ir.Instruction{slot}, entry.Insts[n:]...)...)
+	ctx.fn.allocas++
+	return slot
+}
+
+// variable is a variable of the source program. It lives in a stack slot or a
+// box on the heap, is a fixed SSA value such as the phi of a for loop, or,
+// with none of them, has its values tracked per block by the SSA builder.
+type variable struct {
+	name  string
+	typ   types.Type
+	slot  *ir.InstAlloca
+	box   value.Value
+	value value.Value
+	// managed is set for a reference counted variable with GCRefCount, which
+	// holds a reference of its own
+	managed bool
+	// root is the slot that keeps the environment of a closure variable
+	// alive with GCShadowStack, a closure is no pointer the shadow stack
+	// could scan
+	root *ir.InstAlloca
+}
+
+// addr returns the address the variable lives at, nil for SSA values.
+func (v *variable) addr() value.Value {
+	if v.slot != nil {
+		return v.slot
+	}
+	return v.box
+}
+
+func (c Context) lookupVariable(name string) *variable {
 	if v, ok := c.vars[name]; ok {
 		return v
 	} else if c.parent != nil {
@@ -150,68 +749,404 @@ func (c Context) lookupVariable(name string) value.Value {
 	}
 }
 
+func (ctx *Context) readVariable(v *variable) value.Value {
+	switch {
+	case v.addr() != nil:
+		load := ctx.NewLoad(v.typ, v.addr())
+		load.Volatile = v.slot != nil && ctx.fn.varsInMemory
+		load.SetName(ctx.fn.newName(v.name))
+		return load
+	case v.value != nil:
+		return v.value
+	default:
+		return ctx.fn.ssa.readVariable(v, ctx.Block)
+	}
+}
+
+func (ctx *Context) writeVariable(v *variable, val value.Value) {
+	val = ctx.coerce(val, v.typ)
+	if v.root != nil {
+		ctx.NewStore(ctx.NewExtractValue(val, 0), v.root)
+	}
+	switch {
+	case v.addr() != nil:
+		ctx.NewStore(val, v.addr()).Volatile = v.slot != nil && ctx.fn.varsInMemory
+	case v.value != nil:
+		panic(fmt.Sprintf("cannot assign to loop variable `%s`", v.name))
+	default:
+		ctx.fn.ssa.writeVariable(v, ctx.Block, val)
+		if d := ctx.fn.debug; d != nil {
+			d.value(ctx, v, val)
+		}
+	}
+}
+
+// defineVariable introduces a new variable in the scope of ctx, val is nil
+// for a variable without initial value.
+func (ctx *Context) defineVariable(name string, typ types.Type, val value.Value) {
+	v := &variable{name: name, typ: typ}
+	if ClosureSig(typ) != nil && ctx.fn.gc == GCShadowStack {
+		v.root = ctx.newAlloca(TPtr(TI8), name+".env")
+	}
+	if ctx.fn.closures.boxed[name] {
+		v.box = NewHeap(ctx.Block, typ, WithGC(ctx.fn.gc))
+		if ctx.fn.gc == GCShadowStack {
+			// a root for the rest of the call, the environments of the
+			// closures that share the box keep it alive after
+			ctx.NewStore(v.box, ctx.newAlloca(v.box.Type(), name+".box"))
+		}
+		if val == nil {
+			val = constant.NewZeroInitializer(typ)
+		}
+	} else if ctx.fn.inMemory(name, typ) {
+		v.slot = ctx.newAlloca(typ, name)
+		// the shadow stack scans its roots for the whole call, they get no
+		// lifetime that stack coloring could reuse them outside of
+		if !ctx.fn.isRoot(typ) {
+			ctx.slots = append(ctx.slots, v.slot)
+			ctx.lifetimeMarker("llvm.lifetime.start.p0i8", v.slot)
+		}
+		if d := ctx.fn.debug; d != nil {
+			d.declare(ctx, v)
+		}
+	} else if val == nil {
+		val = constant.NewUndef(typ)
+	}
+	if val != nil {
+		ctx.writeVariable(v, val)
+	}
+	ctx.vars[name] = v
+}
+
+// exitScopes leaves the scopes from ctx up to and including outer, or all
+// scopes of the function when outer is nil. It is called wherever control
+// leaves a scope: it runs the cleanups of the scopes, releases their reference
+// counted variables and ends their stack slots, so that stack coloring can
+// reuse the slots of scopes that are not live at the same time.
+func (ctx *Context) exitScopes(outer *Context) {
+	for c := ctx; c != nil; c = c.parent {
+		ctx.exitScope(c, c.size())
+		if ctx.HasTerminator() {
+			// a cleanup returned, which left the scopes already
+			return
+		}
+		if c == outer {
+			return
+		}
+	}
+}
+
+// scopeSize is how much a scope has to leave: its first cleanups, owned
+// variables and stack slots.
+type scopeSize struct {
+	cleanups, owned, slots int
+}
+
+func (ctx *Context) size() scopeSize {
+	return scopeSize{cleanups: len(ctx.cleanups), owned: len(ctx.owned), slots: len(ctx.slots)}
+}
+
+// exitScope leaves the first n of the scope c from ctx, which is c or a scope
+// nested in it.
+func (ctx *Context) exitScope(c *Context, n scopeSize) {
+	ctx.runCleanups(c, n.cleanups)
+	if ctx.HasTerminator() {
+		return
+	}
+	for i := n.owned - 1; i >= 0; i-- {
+		Release(ctx.Block, ctx.readVariable(c.owned[i]))
+	}
+	for i := n.slots - 1; i >= 0; i-- {
+		ctx.lifetimeMarker("llvm.lifetime.end.p0i8", c.slots[i])
+	}
+}
+
+func (ctx *Context) lifetimeMarker(intrinsic string, slot *ir.InstAlloca) {
+	marker := ctx.fn.declare(intrinsic, types.Void,
+		ir.NewParam("size", types.I64),
+		ir.NewParam("ptr", types.NewPointer(types.I8)),
+	)
+	// size -1 covers the whole slot
+	ctx.NewCall(marker, CI64(-1), ctx.NewBitCast(slot, types.NewPointer(types.I8)))
+}
+
+// seal tells the SSA builder that all predecessors of b are known.
+func (ctx *Context) seal(b *ir.Block) {
+	if ctx.fn.ssa != nil {
+		ctx.fn.ssa.sealBlock(b)
+	}
+}
+
+// moveTo makes b the block that subsequent code of ctx is emitted into.
+func (ctx *Context) moveTo(b *ir.Block) {
+	ctx.ExtBlock = extend.Block(b)
+}
+
+// lookupBreakContext returns the context of the loop or switch a `break` in
+// ctx leaves.
+func (ctx *Context) lookupBreakContext() *Context {
+	if ctx.leaveBlock != nil {
+		return ctx
+	} else if ctx.parent != nil {
+		return ctx.parent.lookupBreakContext()
+	}
+	panic("break outside of loop or switch")
+}
+
+// leaveScope ends the scope of ctx when its code falls through.
+func (ctx *Context) leaveScope() {
+	if !ctx.HasTerminator() {
+		ctx.exitScopes(ctx)
+	}
+}
+
 func (ctx *Context) compileStmt(stmt Stmt) {
-	if !ctx.BelongsToFunc() {
+	if !ctx.BelongsToFunc() || stmt == nil {
 		return
 	}
 	f := ctx.Parent
+	if ctx.HasTerminator() {
+		// code after return or break can never run, it goes to a block that
+		// has no predecessor and is removed when the function is finished
+		ctx.moveTo(f.NewBlock(""))
+		ctx.seal(ctx.Block)
+	}
+	if d := ctx.fn.debug; d != nil && posOf(stmt) != (Pos{}) {
+		defer d.enterStmt(posOf(stmt))()
+	}
 	switch s := stmt.(type) {
+	case *SBlock:
+		blockCtx := ctx.NewContext(ctx.Block)
+		for _, stmt := range s.Stmts {
+			blockCtx.compileStmt(stmt)
+		}
+		blockCtx.leaveScope()
+		ctx.moveTo(blockCtx.Block)
 	case *SIf:
-		thenCtx := ctx.NewContext(f.NewBlock("if.then"))
+		thenCtx := ctx.NewContext(ctx.newBlock("if.then"))
+		elseCtx := ctx.NewContext(ctx.newBlock("if.else"))
+		ctx.NewCondBr(ctx.compileCond(s.Cond), thenCtx.Block, elseCtx.Block)
+		ctx.seal(thenCtx.Block)
+		ctx.seal(elseCtx.Block)
 		thenCtx.compileStmt(s.Then)
-		elseCtx := ctx.NewContext(f.NewBlock("if.else"))
+		thenCtx.leaveScope()
 		elseCtx.compileStmt(s.Else)
-		ctx.NewCondBr(ctx.compileExpr(s.Cond), thenCtx.Block, elseCtx.Block)
+		elseCtx.leaveScope()
+		leaveB := ctx.newBlock("leave.if")
 		if !thenCtx.HasTerminator() {
-			leaveB := f.NewBlock("leave.if")
 			thenCtx.NewBr(leaveB)
 		}
+		if !elseCtx.HasTerminator() {
+			elseCtx.NewBr(leaveB)
+		}
+		ctx.seal(leaveB)
+		ctx.moveTo(leaveB)
 	case *SSwitch:
+		leaveB := ctx.newBlock("leave.switch")
 		cases := []*ir.Case{}
+		caseCtxs := []*Context{}
 		for _, ca := range s.CaseList {
-			caseB := f.NewBlock("switch.case")
-			ctx.NewContext(caseB).compileStmt(ca.Stmt)
-			cases = append(cases, ir.NewCase(compileConstant(ca.EConstant), caseB))
+			caseCtx := ctx.NewContext(ctx.newBlock("switch.case"))
+			caseCtx.leaveBlock = leaveB
+			cases = append(cases, ir.NewCase(compileConstant(ca.EConstant), caseCtx.Block))
+			caseCtxs = append(caseCtxs, caseCtx)
+		}
+		defaultCtx := ctx.NewContext(ctx.newBlock("switch.default"))
+		defaultCtx.leaveBlock = leaveB
+		caseCtxs = append(caseCtxs, defaultCtx)
+		ctx.NewSwitch(ctx.compileCond(s.Target), defaultCtx.Block, cases...)
+		for _, caseCtx := range caseCtxs {
+			ctx.seal(caseCtx.Block)
 		}
-		defaultB := f.NewBlock("switch.default")
-		ctx.NewContext(defaultB).compileStmt(s.DefaultCase)
-		ctx.NewSwitch(ctx.compileExpr(s.Target), defaultB, cases...)
+		for i, ca := range s.CaseList {
+			caseCtxs[i].compileStmt(ca.Stmt)
+		}
+		defaultCtx.compileStmt(s.DefaultCase)
+		for _, caseCtx := range caseCtxs {
+			caseCtx.leaveScope()
+			if !caseCtx.HasTerminator() {
+				caseCtx.NewBr(leaveB)
+			}
+		}
+		// keep the leave block after the cases in the function layout
+		moveBlockToEnd(f, leaveB)
+		ctx.seal(leaveB)
+		ctx.moveTo(leaveB)
 	case *SDoWhile:
-		doCtx := ctx.NewContext(f.NewBlock("do.while.body"))
-		ctx.NewBr(doCtx.Block)
-		leaveB := f.NewBlock("leave.do.while")
+		bodyB := ctx.newBlock("do.while.body")
+		doCtx := ctx.NewContext(bodyB)
+		ctx.NewBr(bodyB)
+		leaveB := ctx.newBlock("leave.do.while")
 		doCtx.leaveBlock = leaveB
 		doCtx.compileStmt(s.Block)
-		doCtx.NewCondBr(doCtx.compileExpr(s.Cond), doCtx.Block, leaveB)
+		if !doCtx.HasTerminator() {
+			cond := doCtx.compileCond(s.Cond)
+			doCtx.leaveScope()
+			if !doCtx.HasTerminator() {
+				doCtx.NewCondBr(cond, bodyB, leaveB)
+			}
+		}
+		ctx.seal(bodyB)
+		moveBlockToEnd(f, leaveB)
+		ctx.seal(leaveB)
+		ctx.moveTo(leaveB)
 	case *SForLoop:
-		loopCtx := ctx.NewContext(f.NewBlock("for.loop.body"))
-		ctx.NewBr(loopCtx.Block)
-		firstAppear := loopCtx.NewPhi(ir.NewIncoming(loopCtx.compileExpr(s.InitExpr), ctx.Block))
-		loopCtx.vars[s.InitName] = firstAppear
-		step := loopCtx.compileExpr(s.Step)
-		firstAppear.Incs = append(firstAppear.Incs, ir.NewIncoming(step, loopCtx.Block))
-		loopCtx.vars[s.InitName] = step
-		leaveB := f.NewBlock("leave.for.loop")
+		bodyB := ctx.newBlock("for.loop.body")
+		loopCtx := ctx.NewContext(bodyB)
+		init := ctx.compileExpr(s.InitExpr)
+		x := &variable{name: s.InitName, typ: init.Type()}
+		loopCtx.vars[s.InitName] = x
+		if ctx.fn.varsInMemory {
+			x.slot = ctx.newAlloca(x.typ, s.InitName)
+			ctx.NewStore(init, x.slot).Volatile = true
+		}
+		ctx.NewBr(bodyB)
+		var firstAppear *ir.InstPhi
+		if x.slot != nil {
+			loopCtx.writeVariable(x, loopCtx.compileExpr(s.Step))
+		} else if ctx.fn.ssa != nil {
+			// the header is not sealed yet, reading the variable in it places
+			// the phi that the trick below builds by hand
+			ctx.fn.ssa.writeVariable(x, ctx.Block, init)
+			loopCtx.writeVariable(x, loopCtx.compileExpr(s.Step))
+		} else {
+			firstAppear = loopCtx.NewPhi(ir.NewIncoming(init, ctx.Block))
+			firstAppear.SetName(ctx.fn.newName(s.InitName))
+			x.value = firstAppear
+			x.value = loopCtx.compileExpr(s.Step)
+		}
+		leaveB := ctx.newBlock("leave.for.loop")
 		loopCtx.leaveBlock = leaveB
 		loopCtx.compileStmt(s.Block)
-		loopCtx.NewCondBr(loopCtx.compileExpr(s.Cond), loopCtx.Block, leaveB)
+		if !loopCtx.HasTerminator() {
+			if firstAppear != nil {
+				// the body might end in another block than it starts, the back
+				// edge comes from wherever it ends
+				firstAppear.Incs = append(firstAppear.Incs, ir.NewIncoming(x.value, loopCtx.Block))
+			}
+			cond := loopCtx.compileCond(s.Cond)
+			loopCtx.leaveScope()
+			if !loopCtx.HasTerminator() {
+				loopCtx.NewCondBr(cond, bodyB, leaveB)
+			}
+		}
+		ctx.seal(bodyB)
+		moveBlockToEnd(f, leaveB)
+		ctx.seal(leaveB)
+		ctx.moveTo(leaveB)
 	case *SWhile:
-		condCtx := ctx.NewContext(f.NewBlock("while.loop.cond"))
+		condCtx := ctx.NewContext(ctx.newBlock("while.loop.cond"))
 		ctx.NewBr(condCtx.Block)
-		loopCtx := ctx.NewContext(f.NewBlock("while.loop.body"))
-		leaveB := f.NewBlock("leave.do.while")
-		condCtx.NewCondBr(condCtx.compileExpr(s.Cond), loopCtx.Block, leaveB)
+		loopCtx := ctx.NewContext(ctx.newBlock("while.loop.body"))
+		leaveB := ctx.newBlock("leave.while.loop")
+		condCtx.NewCondBr(condCtx.compileCond(s.Cond), loopCtx.Block, leaveB)
+		ctx.seal(loopCtx.Block)
 		condCtx.leaveBlock = leaveB
 		loopCtx.leaveBlock = leaveB
 		loopCtx.compileStmt(s.Block)
-		loopCtx.NewBr(condCtx.Block)
+		loopCtx.leaveScope()
+		if !loopCtx.HasTerminator() {
+			loopCtx.NewBr(condCtx.Block)
+		}
+		ctx.seal(condCtx.Block)
+		moveBlockToEnd(f, leaveB)
+		ctx.seal(leaveB)
+		ctx.moveTo(leaveB)
 	case *SDefine:
-		v := ctx.NewAlloca(s.Typ)
-		ctx.NewStore(ctx.compileExpr(s.Expr), v)
-		ctx.vars[s.Name] = v
+		var v value.Value
+		// a reference counted variable without initial value is null until
+		// assigned
+		managed := s.Expr == nil && ctx.fn.gc == GCRefCount && isPointer(s.Typ)
+		if s.Expr != nil {
+			v, managed = ctx.compileOwned(s.Expr)
+		} else if managed {
+			v = constant.NewNull(s.Typ.(*types.PointerType))
+		}
+		typ := s.Typ
+		if typ == nil {
+			// the type is inferred from the initial value
+			typ = v.Type()
+		}
+		ctx.defineVariable(s.Name, typ, v)
+		if managed {
+			ctx.own(ctx.vars[s.Name])
+		}
+	case *SAssign:
+		v := ctx.lookupVariable(s.Name)
+		val, managed := ctx.compileOwned(s.Expr)
+		switch {
+		case v.managed:
+			if !managed {
+				panic(fmt.Sprintf("cannot assign a pointer that is not reference counted to `%s`", v.name))
+			}
+			// the new reference is retained before the old one is released,
+			// for `x = x`
+			old := ctx.readVariable(v)
+			ctx.writeVariable(v, val)
+			Release(ctx.Block, old)
+		case managed:
+			panic(fmt.Sprintf("cannot assign a reference counted pointer to `%s`, which is not", v.name))
+		default:
+			ctx.writeVariable(v, val)
+		}
 	case *SRet:
-		ctx.NewRet(ctx.compileExpr(s.Val))
+		// the caller gets a reference of its own
+		v, _ := ctx.compileOwned(s.Val)
+		if v != nil {
+			v = ctx.coerce(v, f.Sig.RetType)
+		}
+		ctx.releaseTemps()
+		ctx.exitScopes(nil)
+		// unless a cleanup returned or threw
+		if !ctx.HasTerminator() {
+			ctx.NewRet(v)
+		}
+	case *SStore:
+		var ptr value.Value
+		if field, ok := s.Target.(*EField); ok {
+			ptr, _ = ctx.compileField(field)
+			if ptr == nil {
+				panic("cannot store into a field of a struct value")
+			}
+		} else {
+			ptr = ctx.compileAddr(s.Target)
+		}
+		if isPointer(elemType(ptr)) && ctx.isManaged(s.Target) {
+			val, managed := ctx.compileOwned(s.Expr)
+			if !managed {
+				panic("an object can only hold pointers to objects of ENew")
+			}
+			old := ctx.NewLoad(elemType(ptr), ptr)
+			ctx.NewStore(val, ptr)
+			Release(ctx.Block, old)
+		} else {
+			if _, ok := s.Expr.(*ENew); ok && ctx.fn.gc == GCRefCount {
+				panic("a new object must be held by a variable or an object")
+			}
+			ctx.NewStore(ctx.coerce(ctx.compileExpr(s.Expr), elemType(ptr)), ptr)
+		}
+	case *SFree:
+		Free(ctx.Block, ctx.compileExpr(s.Expr))
+	case *SExpr:
+		ctx.compileExpr(s.Expr)
+	case *STry:
+		ctx.compileTry(s)
+	case *SThrow:
+		ctx.compileThrow(s)
+	case *SDefer:
+		ctx.cleanups = append(ctx.cleanups, func(c *Context) {
+			c.compileStmt(s.Body)
+		})
+	case *SPrint:
+		ctx.NewCall(ctx.fn.strings().Print, ctx.compileExpr(s.Expr))
 	case *SBreak:
-		ctx.NewBr(ctx.leaveBlock)
+		target := ctx.lookupBreakContext()
+		ctx.exitScopes(target)
+		if !ctx.HasTerminator() {
+			ctx.NewBr(target.leaveBlock)
+		}
+	}
+	if !ctx.HasTerminator() {
+		ctx.releaseTemps()
 	}
 }
@@ -0,0 +1,218 @@
+package controlflow
+
+import (
+	"fmt"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+	. "github.com/llir/researchllvm/helper"
+)
+
+// closureInfo tells how the lambdas of a function body are compiled. Names are
+// not resolved to scopes, like in addressTaken.
+type closureInfo struct {
+	// escaping are the lambdas whose closure may outlive the function, their
+	// environment is allocated on the heap
+	escaping map[*ELambda]bool
+	// byRef are the variables captured by reference, they live in memory
+	byRef map[string]bool
+	// boxed are the variables captured by reference by an escaping lambda,
+	// they live in a box on the heap
+	boxed map[string]bool
+}
+
+// analyzeClosures finds the lambdas of body that escape. A closure does not
+// escape when it is called right away, or only ever called through the
+// variable it is defined or assigned to; any other use of it, passing it,
+// returning it, storing it or capturing it in another lambda, may let it
+// outlive the function.
+func analyzeClosures(body Stmt) *closureInfo {
+	info := &closureInfo{
+		escaping: map[*ELambda]bool{},
+		byRef:    map[string]bool{},
+		boxed:    map[string]bool{},
+	}
+	callees := map[Expr]bool{}
+	// the variables that lambdas are defined or assigned to
+	holders := map[*ELambda]string{}
+	// the variables that are used other than by calling them
+	passed := map[string]bool{}
+	var lambdas []*ELambda
+	inspect(body, func(s Stmt) {
+		switch s := s.(type) {
+		case *SDefine:
+			if l, ok := s.Expr.(*ELambda); ok {
+				holders[l] = s.Name
+			}
+		case *SAssign:
+			if l, ok := s.Expr.(*ELambda); ok {
+				holders[l] = s.Name
+			}
+		}
+	}, func(e Expr) {
+		switch e := e.(type) {
+		case *ECall:
+			callees[e.Callee] = true
+		case *EVariable:
+			if !callees[e] {
+				passed[e.Name] = true
+			}
+		case *ELambda:
+			lambdas = append(lambdas, e)
+			for _, name := range freeVariables(e.Params, e.Body) {
+				passed[name] = true
+			}
+		}
+	})
+	for _, l := range lambdas {
+		name, held := holders[l]
+		info.escaping[l] = !callees[l] && (!held || passed[name])
+		for name := range refCaptures(l) {
+			info.byRef[name] = true
+			if info.escaping[l] {
+				info.boxed[name] = true
+			}
+		}
+	}
+	return info
+}
+
+// refCaptures returns the variables that e captures by reference: those named
+// in ByRef, and those that its nested lambdas capture by reference, whose
+// box e has to pass on.
+func refCaptures(e *ELambda) map[string]bool {
+	free := map[string]bool{}
+	for _, name := range freeVariables(e.Params, e.Body) {
+		free[name] = true
+	}
+	names := map[string]bool{}
+	for _, name := range e.ByRef {
+		if free[name] {
+			names[name] = true
+		}
+	}
+	inspect(e.Body, nil, func(nested Expr) {
+		if nested, ok := nested.(*ELambda); ok {
+			for name := range refCaptures(nested) {
+				if free[name] {
+					names[name] = true
+				}
+			}
+		}
+	})
+	return names
+}
+
+// compileLambda lifts the body of e into a function of the module and returns
+// the closure of it. The environment holds a copy of the variables captured by
+// value and the address of those captured by reference.
+func (ctx *Context) compileLambda(e *ELambda) value.Value {
+	name := ctx.Parent.Name() + "." + ctx.fn.newName("lambda")
+	retType := e.RetType
+	if retType == nil {
+		retType = types.Void
+	}
+	envParam := ir.NewParam("env", TPtr(TI8))
+	params := []*ir.Param{envParam}
+	for _, param := range e.Params {
+		params = append(params, ir.NewParam(param.Name, param.Typ))
+	}
+	lifted := ctx.fn.module().NewFunc(name, retType, params...)
+
+	var env *Struct
+	// no environment without captures
+	var envPtr value.Value
+	byRef := refCaptures(e)
+	if captures := freeVariables(e.Params, e.Body); len(captures) > 0 {
+		var fields []Field
+		for _, name := range captures {
+			typ := ctx.lookupVariable(name).typ
+			if byRef[name] {
+				typ = TPtr(typ)
+			}
+			fields = append(fields, Field{Name: name, Typ: typ})
+		}
+		env = NewStruct(ctx.fn.module(), name+".env", fields...)
+		var envObj value.Value
+		if ctx.fn.closures.escaping[e] {
+			if ctx.fn.gc == GCRefCount {
+				// closures are values that are copied, not counted
+				panic(fmt.Sprintf("lambda `%s` escapes with captured variables, which GCRefCount cannot release", name))
+			}
+			envObj = NewHeap(ctx.Block, env.Typ, WithGC(ctx.fn.gc))
+		} else {
+			envObj = ctx.newAlloca(env.Typ, "env")
+		}
+		for _, name := range captures {
+			v := ctx.lookupVariable(name)
+			var val value.Value
+			if byRef[name] {
+				// the variable is in memory, see inMemory
+				val = v.addr()
+			} else {
+				val = ctx.readVariable(v)
+			}
+			ctx.NewStore(val, env.GEP(ctx.Block, envObj, name))
+		}
+		envPtr = ctx.NewBitCast(envObj, TPtr(TI8))
+	}
+
+	err := compileFunc(lifted, e.Body, func(body *Context) {
+		for i, param := range e.Params {
+			body.defineVariable(param.Name, param.Typ, lifted.Params[i+1])
+		}
+		if env == nil {
+			return
+		}
+		if body.fn.gc == GCShadowStack {
+			// the caller may hold the closure in a register alone
+			body.NewStore(envParam, body.newAlloca(TPtr(TI8), "env.root"))
+		}
+		captured := body.NewBitCast(envParam, TPtr(env.Typ))
+		for _, field := range env.Fields {
+			val := body.NewLoad(field.Typ, env.GEP(body.Block, captured, field.Name))
+			if byRef[field.Name] {
+				// the variable of the enclosing function itself
+				typ := field.Typ.(*types.PointerType).ElemType
+				body.vars[field.Name] = &variable{name: field.Name, typ: typ, box: val}
+			} else {
+				body.defineVariable(field.Name, field.Typ, val)
+			}
+		}
+	}, ctx.fn.opts)
+	if err != nil && ctx.fn.err == nil {
+		// compileFunc of the enclosing function returns it
+		ctx.fn.err = fmt.Errorf("lambda `%s`: %v", name, err)
+	}
+
+	return MakeClosure(ctx.Block, envPtr, lifted)
+}
+
+// compileCall calls a function pointer directly, or a closure with its
+// environment as the first argument.
+func (ctx *Context) compileCall(e *ECall) value.Value {
+	callee := ctx.compileExpr(e.Callee)
+	if sig := FuncSig(callee.Type()); sig != nil {
+		return ctx.call(callee, ctx.compileArgs(sig.Params, e.Args)...)
+	}
+	sig := ClosureSig(callee.Type())
+	if sig == nil {
+		panic(fmt.Sprintf("cannot call a value of type %s", callee.Type()))
+	}
+	// the call of CallClosure, made by ctx.call for exceptions
+	args := []value.Value{ctx.NewExtractValue(callee, 0)}
+	args = append(args, ctx.compileArgs(sig.Params, e.Args)...)
+	return ctx.call(ctx.NewExtractValue(callee, 1), args...)
+}
+
+func (ctx *Context) compileArgs(params []types.Type, exprs []Expr) []value.Value {
+	if len(params) != len(exprs) {
+		panic(fmt.Sprintf("call with %d arguments, want %d", len(exprs), len(params)))
+	}
+	var args []value.Value
+	for i, e := range exprs {
+		args = append(args, ctx.coerce(ctx.compileExpr(e), params[i]))
+	}
+	return args
+}
@@ -0,0 +1,118 @@
+package controlflow
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/types"
+	. "github.com/llir/researchllvm/helper"
+)
+
+func TestLambda(t *testing.T) {
+	m := ir.NewModule()
+	f := m.NewFunc("main", types.I32)
+	i := &EVariable{Name: "i"}
+
+	err := CompileFunc(f, &SBlock{Stmts: []Stmt{
+		&SDefine{Name: "i", Expr: &EI32{V: 10}},
+		// both capture i by value
+		&SDefine{Name: "id", Expr: &ELambda{RetType: types.I32, Body: &SRet{Val: i}}},
+		&SDefine{Name: "add", Expr: &ELambda{
+			Params:  []Param{{Name: "x", Typ: types.I32}},
+			RetType: types.I32,
+			Body:    &SRet{Val: &EAdd{Lhs: &EVariable{Name: "x"}, Rhs: i}},
+		}},
+		// the closures keep their copy of i
+		&SAssign{Name: "i", Expr: &EI32{V: 0}},
+		&SDefine{Name: "r", Expr: &ECall{
+			Callee: &EVariable{Name: "add"},
+			Args:   []Expr{&ECall{Callee: &EVariable{Name: "id"}}},
+		}},
+		// exits with 0 when r is 20
+		&SRet{Val: &ESub{Lhs: &EVariable{Name: "r"}, Rhs: &EI32{V: 20}}},
+	}}, WithSSA())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	PrettyPrint(m)
+
+	ExecuteIR(m)
+}
+
+func TestLambdaByRef(t *testing.T) {
+	m := ir.NewModule()
+	n, x := &EVariable{Name: "n"}, &EVariable{Name: "x"}
+	closure := types.NewStruct(TPtr(TI8), TPtr(types.NewFunc(types.I32, TPtr(TI8))))
+
+	// the closure outlives counter, its environment and n are on the heap
+	counter := m.NewFunc("counter", closure)
+	err := CompileFunc(counter, &SBlock{Stmts: []Stmt{
+		&SDefine{Name: "n", Expr: &EI32{V: 0}},
+		&SRet{Val: &ELambda{
+			RetType: types.I32,
+			ByRef:   []string{"n"},
+			Body: &SBlock{Stmts: []Stmt{
+				&SAssign{Name: "n", Expr: &EAdd{Lhs: n, Rhs: &EI32{V: 1}}},
+				&SRet{Val: n},
+			}},
+		}},
+	}}, WithSSA())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := m.NewFunc("main", types.I32)
+	err = CompileFunc(f, &SBlock{Stmts: []Stmt{
+		&SDefine{Name: "c", Expr: &ECall{Callee: &EFunc{F: counter}}},
+		&SExpr{Expr: &ECall{Callee: &EVariable{Name: "c"}}},
+		&SExpr{Expr: &ECall{Callee: &EVariable{Name: "c"}}},
+		// 3
+		&SDefine{Name: "r", Expr: &ECall{Callee: &EVariable{Name: "c"}}},
+
+		// inc, get and main share x, which stays on the stack
+		&SDefine{Name: "x", Expr: &EI32{V: 1}},
+		&SDefine{Name: "inc", Expr: &ELambda{
+			ByRef: []string{"x"},
+			Body:  &SAssign{Name: "x", Expr: &EAdd{Lhs: x, Rhs: &EI32{V: 1}}},
+		}},
+		&SDefine{Name: "get", Expr: &ELambda{
+			RetType: types.I32,
+			ByRef:   []string{"x"},
+			Body:    &SRet{Val: x},
+		}},
+		&SExpr{Expr: &ECall{Callee: &EVariable{Name: "inc"}}},
+		&SAssign{Name: "x", Expr: &EMul{Lhs: x, Rhs: &EI32{V: 10}}},
+		// 20
+		&SDefine{Name: "y", Expr: &ECall{Callee: &EVariable{Name: "get"}}},
+
+		// exits with 0 when r is 3 and y is 20
+		&SRet{Val: &EAdd{
+			Lhs: &ESub{Lhs: &EVariable{Name: "r"}, Rhs: &EI32{V: 3}},
+			Rhs: &ESub{Lhs: &EVariable{Name: "y"}, Rhs: &EI32{V: 20}},
+		}},
+	}}, WithSSA())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	PrettyPrint(m)
+
+	ExecuteIR(m)
+}
+
+func TestLambdaMissingReturn(t *testing.T) {
+	m := ir.NewModule()
+	f := m.NewFunc("main", types.I32)
+
+	err := CompileFunc(f, &SBlock{Stmts: []Stmt{
+		&SDefine{Name: "f", Expr: &ELambda{RetType: types.I32, Body: &SBlock{}}},
+		&SRet{Val: &EI32{V: 0}},
+	}})
+	if err == nil {
+		t.Fatal("expected an error for a lambda falling off the end of a non-void body")
+	}
+
+	fmt.Println(err)
+}
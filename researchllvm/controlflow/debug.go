@@ -0,0 +1,319 @@
+package controlflow
+
+import (
+	"path/filepath"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/enum"
+	"github.com/llir/llvm/ir/metadata"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+	. "github.com/llir/researchllvm/helper"
+)
+
+// WithDebugInfo emits DWARF debug info that maps the function back to the
+// positions of its statements in filename. The function must belong to a
+// module, which gets the compile unit of filename.
+func WithDebugInfo(filename string) Option {
+	return func(fc *funcContext) {
+		fc.debug = newDebugInfo(fc.entry.Parent, filename)
+	}
+}
+
+type debugInfo struct {
+	f     *ir.Func
+	mod   *ir.Module
+	file  *metadata.DIFile
+	sp    *metadata.DISubprogram
+	locs  map[Pos]*metadata.DILocation
+	vars  map[*variable]*metadata.DILocalVariable
+	types map[types.Type]metadata.Field
+	// position of the statement being compiled
+	cur Pos
+	// attached are the instructions that have a location already, SSA
+	// construction inserts and removes instructions anywhere in a block
+	attached map[ir.Instruction]bool
+}
+
+func newDebugInfo(f *ir.Func, filename string) *debugInfo {
+	if f.Parent == nil {
+		panic("debug info needs the function to belong to a module")
+	}
+	d := &debugInfo{
+		f:        f,
+		mod:      f.Parent,
+		locs:     make(map[Pos]*metadata.DILocation),
+		vars:     make(map[*variable]*metadata.DILocalVariable),
+		types:    make(map[types.Type]metadata.Field),
+		attached: make(map[ir.Instruction]bool),
+	}
+	cu := d.compileUnit(filename)
+	d.file = cu.File
+	d.sp = &metadata.DISubprogram{
+		MetadataID: -1,
+		Distinct:   true,
+		Name:       f.Name(),
+		Scope:      cu.File,
+		File:       cu.File,
+		Type:       d.subroutineType(f.Sig),
+		Flags:      enum.DIFlagPrototyped,
+		SPFlags:    enum.DISPFlagDefinition,
+		Unit:       cu,
+	}
+	d.add(d.sp)
+	f.Metadata = append(f.Metadata, &metadata.Attachment{Name: "dbg", Node: d.sp})
+	return d
+}
+
+// compileUnit returns the compile unit of filename in the module, the first
+// function compiled from a file creates it. Files of the same name in other
+// directories have units of their own.
+func (d *debugInfo) compileUnit(filename string) *metadata.DICompileUnit {
+	if d.mod.NamedMetadataDefs == nil {
+		d.mod.NamedMetadataDefs = make(map[string]*metadata.NamedDef)
+	}
+	cus, ok := d.mod.NamedMetadataDefs["llvm.dbg.cu"]
+	if !ok {
+		cus = &metadata.NamedDef{Name: "llvm.dbg.cu"}
+		d.mod.NamedMetadataDefs[cus.Name] = cus
+		d.addModuleFlag(2, "Dwarf Version", 4)
+		d.addModuleFlag(2, "Debug Info Version", 3)
+	}
+	base, dir := filepath.Base(filename), filepath.Dir(filename)
+	for _, node := range cus.Nodes {
+		if cu, ok := node.(*metadata.DICompileUnit); ok && cu.File.Filename == base && cu.File.Directory == dir {
+			return cu
+		}
+	}
+	file := &metadata.DIFile{
+		MetadataID: -1,
+		Filename:   base,
+		Directory:  dir,
+	}
+	d.add(file)
+	cu := &metadata.DICompileUnit{
+		MetadataID:   -1,
+		Distinct:     true,
+		Language:     enum.DwarfLangC99,
+		File:         file,
+		Producer:     "researchllvm controlflow",
+		EmissionKind: enum.EmissionKindFullDebug,
+	}
+	d.add(cu)
+	cus.Nodes = append(cus.Nodes, cu)
+	return cu
+}
+
+func (d *debugInfo) addModuleFlag(behavior int64, key string, val int64) {
+	flags, ok := d.mod.NamedMetadataDefs["llvm.module.flags"]
+	if !ok {
+		flags = &metadata.NamedDef{Name: "llvm.module.flags"}
+		d.mod.NamedMetadataDefs[flags.Name] = flags
+	}
+	flag := &metadata.Tuple{
+		MetadataID: -1,
+		Fields: []metadata.Field{
+			CI32(behavior),
+			&metadata.String{Value: key},
+			CI32(val),
+		},
+	}
+	d.add(flag)
+	flags.Nodes = append(flags.Nodes, flag)
+}
+
+// add makes node an unnamed metadata definition of the module, llir numbers
+// them when the module is printed.
+func (d *debugInfo) add(node metadata.Definition) {
+	d.mod.MetadataDefs = append(d.mod.MetadataDefs, node)
+}
+
+// enterStmt starts a statement at pos. Code emitted so far belongs to the
+// enclosing statement; the returned function ends the statement, attaching
+// its location to the code emitted by it and not by nested statements.
+func (d *debugInfo) enterStmt(pos Pos) func() {
+	outer := d.cur
+	d.attach(outer)
+	d.cur = pos
+	return func() {
+		d.attach(pos)
+		d.cur = outer
+	}
+}
+
+// attach sets the location pos on the instructions emitted since the last
+// call.
+func (d *debugInfo) attach(pos Pos) {
+	if pos == (Pos{}) {
+		return
+	}
+	loc := d.location(pos)
+	for _, b := range d.f.Blocks {
+		for _, inst := range b.Insts {
+			if !d.attached[inst] {
+				setDebugLocation(inst, loc)
+				d.attached[inst] = true
+			}
+		}
+		if b.Term != nil {
+			setDebugLocation(b.Term, loc)
+		}
+	}
+}
+
+func (d *debugInfo) location(pos Pos) *metadata.DILocation {
+	if loc, ok := d.locs[pos]; ok {
+		return loc
+	}
+	loc := &metadata.DILocation{
+		MetadataID: -1,
+		Line:       pos.Line,
+		Column:     pos.Col,
+		Scope:      d.sp,
+	}
+	d.add(loc)
+	d.locs[pos] = loc
+	return loc
+}
+
+// setDebugLocation attaches loc to inst as `!dbg` unless it has a location
+// already.
+func setDebugLocation(inst interface{}, loc *metadata.DILocation) {
+	md := attachments(inst)
+	for _, a := range *md {
+		if a.Name == "dbg" {
+			return
+		}
+	}
+	*md = append(*md, &metadata.Attachment{Name: "dbg", Node: loc})
+}
+
+// emptyExpr is the inline `!DIExpression()` of variables located by their
+// slot or value as they are.
+var emptyExpr = &metadata.Value{Value: &metadata.DIExpression{MetadataID: -1}}
+
+// declare describes the stack slot of v with `llvm.dbg.declare`.
+func (d *debugInfo) declare(ctx *Context, v *variable) {
+	dv := d.variable(v)
+	if dv == nil {
+		return
+	}
+	declare := ctx.fn.declare("llvm.dbg.declare", types.Void,
+		ir.NewParam("addr", types.Metadata),
+		ir.NewParam("var", types.Metadata),
+		ir.NewParam("expr", types.Metadata),
+	)
+	ctx.NewCall(declare, &metadata.Value{Value: v.slot}, &metadata.Value{Value: dv}, emptyExpr)
+}
+
+// value describes the SSA value val of v with `llvm.dbg.value`.
+func (d *debugInfo) value(ctx *Context, v *variable, val value.Value) {
+	dv := d.variable(v)
+	if dv == nil {
+		return
+	}
+	dbgValue := ctx.fn.declare("llvm.dbg.value", types.Void,
+		ir.NewParam("value", types.Metadata),
+		ir.NewParam("var", types.Metadata),
+		ir.NewParam("expr", types.Metadata),
+	)
+	ctx.NewCall(dbgValue, &metadata.Value{Value: val}, &metadata.Value{Value: dv}, emptyExpr)
+}
+
+// variable returns the DILocalVariable of v, nil for variables of a type
+// without debug info description.
+func (d *debugInfo) variable(v *variable) *metadata.DILocalVariable {
+	if dv, ok := d.vars[v]; ok {
+		return dv
+	}
+	typ := d.diType(v.typ)
+	if typ == nil {
+		return nil
+	}
+	dv := &metadata.DILocalVariable{
+		MetadataID: -1,
+		Name:       v.name,
+		Scope:      d.sp,
+		File:       d.file,
+		Line:       d.cur.Line,
+		Type:       typ,
+	}
+	d.add(dv)
+	d.vars[v] = dv
+	return dv
+}
+
+// diType describes t, nil when t has no description.
+func (d *debugInfo) diType(t types.Type) metadata.Field {
+	if typ, ok := d.types[t]; ok {
+		return typ
+	}
+	var typ metadata.Field
+	switch t := t.(type) {
+	case *types.IntType:
+		encoding := enum.DwarfAttEncodingSigned
+		if t.BitSize == 1 {
+			encoding = enum.DwarfAttEncodingBoolean
+		}
+		basic := &metadata.DIBasicType{
+			MetadataID: -1,
+			Tag:        enum.DwarfTagBaseType,
+			Name:       t.LLString(),
+			Size:       t.BitSize,
+			Encoding:   encoding,
+		}
+		d.add(basic)
+		typ = basic
+	case *types.FloatType:
+		basic := &metadata.DIBasicType{
+			MetadataID: -1,
+			Tag:        enum.DwarfTagBaseType,
+			Name:       t.LLString(),
+			Size:       floatBitSize(t),
+			Encoding:   enum.DwarfAttEncodingFloat,
+		}
+		d.add(basic)
+		typ = basic
+	case *types.PointerType:
+		var base metadata.Field = &metadata.NullLit{}
+		if elem := d.diType(t.ElemType); elem != nil {
+			base = elem
+		}
+		ptr := &metadata.DIDerivedType{
+			MetadataID: -1,
+			Tag:        enum.DwarfTagPointerType,
+			BaseType:   base,
+		}
+		// the size of pointers is that of the target, left out when the
+		// module does not say
+		if d.mod.DataLayout != "" {
+			ptr.Size = NewDataLayout(d.mod.DataLayout).PointerSize * 8
+		}
+		d.add(ptr)
+		typ = ptr
+	default:
+		return nil
+	}
+	d.types[t] = typ
+	return typ
+}
+
+func (d *debugInfo) subroutineType(sig *types.FuncType) *metadata.DISubroutineType {
+	var ret metadata.Field = &metadata.NullLit{}
+	if typ := d.diType(sig.RetType); typ != nil {
+		ret = typ
+	}
+	fields := []metadata.Field{ret}
+	for _, param := range sig.Params {
+		var typ metadata.Field = &metadata.NullLit{}
+		if t := d.diType(param); t != nil {
+			typ = t
+		}
+		fields = append(fields, typ)
+	}
+	tuple := &metadata.Tuple{MetadataID: -1, Fields: fields}
+	d.add(tuple)
+	st := &metadata.DISubroutineType{MetadataID: -1, Types: tuple}
+	d.add(st)
+	return st
+}
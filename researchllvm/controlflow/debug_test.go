@@ -0,0 +1,108 @@
+package controlflow
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/types"
+	. "github.com/llir/researchllvm/helper"
+)
+
+// foo.src:
+//
+//	1 int foo() {
+//	2   int x = 0;
+//	3   while (x < 10) {
+//	4     x = x + 1;
+//	5   }
+//	6   return x;
+//	7 }
+func TestDebugInfo(t *testing.T) {
+	m := ir.NewModule()
+	f := m.NewFunc("foo", types.I32)
+
+	err := CompileFunc(f, &SBlock{Pos: Pos{Line: 1, Col: 11}, Stmts: []Stmt{
+		&SDefine{Pos: Pos{Line: 2, Col: 3}, Name: "x", Typ: types.I32, Expr: &EI32{V: 0}},
+		&SWhile{
+			Pos:  Pos{Line: 3, Col: 3},
+			Cond: &ELessThan{Lhs: &EVariable{Name: "x"}, Rhs: &EI32{V: 10}},
+			Block: &SAssign{
+				Pos:  Pos{Line: 4, Col: 5},
+				Name: "x",
+				Expr: &EAdd{Lhs: &EVariable{Name: "x"}, Rhs: &EI32{V: 1}},
+			},
+		},
+		&SRet{Pos: Pos{Line: 6, Col: 3}, Val: &EVariable{Name: "x"}},
+	}}, WithDebugInfo("foo.src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Println(m)
+}
+
+// bar.src:
+//
+//	1 int bar() {
+//	2   int x = 0;
+//	3   int y = 10;
+//	4   while (x < y)
+//	5     x = x + 1;
+//	6   return x;
+//	7 }
+func TestDebugInfoSSA(t *testing.T) {
+	m := ir.NewModule()
+	f := m.NewFunc("bar", types.I32)
+
+	err := CompileFunc(f, &SBlock{Pos: Pos{Line: 1, Col: 11}, Stmts: []Stmt{
+		&SDefine{Pos: Pos{Line: 2, Col: 3}, Name: "x", Typ: types.I32, Expr: &EI32{V: 0}},
+		&SDefine{Pos: Pos{Line: 3, Col: 3}, Name: "y", Typ: types.I32, Expr: &EI32{V: 10}},
+		&SWhile{
+			Pos:  Pos{Line: 4, Col: 3},
+			Cond: &ELessThan{Lhs: &EVariable{Name: "x"}, Rhs: &EVariable{Name: "y"}},
+			Block: &SAssign{
+				Pos:  Pos{Line: 5, Col: 5},
+				Name: "x",
+				Expr: &EAdd{Lhs: &EVariable{Name: "x"}, Rhs: &EI32{V: 1}},
+			},
+		},
+		&SRet{Pos: Pos{Line: 6, Col: 3}, Val: &EVariable{Name: "x"}},
+	}}, WithSSA(), WithDebugInfo("bar.src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Println(m)
+}
+
+func TestDebugInfoFiles(t *testing.T) {
+	m := ir.NewModule()
+	m.DataLayout = I386.String()
+	// the same file name in two directories
+	for _, filename := range []string{"a/foo.src", "b/foo.src"} {
+		f := m.NewFunc(strings.Replace(filename, "/foo.src", "_foo", 1), types.Void)
+		err := CompileFunc(f, &SDefine{
+			Pos:  Pos{Line: 1, Col: 1},
+			Name: "p",
+			Typ:  TPtr(TI32),
+			Expr: &ENew{Typ: TI32},
+		}, WithDebugInfo(filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cus := m.NamedMetadataDefs["llvm.dbg.cu"].Nodes; len(cus) != 2 {
+		t.Fatalf("expected a compile unit for each file, got %d", len(cus))
+	}
+
+	out := m.String()
+	// pointers of the target are 32 bits wide
+	if !regexp.MustCompile(`DW_TAG_pointer_type, baseType: !\d+, size: 32\)`).MatchString(out) {
+		t.Fatalf("expected a 32 bit pointer type:\n%s", out)
+	}
+
+	fmt.Println(out)
+}
@@ -0,0 +1,115 @@
+package controlflow
+
+import (
+	"testing"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/types"
+	. "github.com/llir/researchllvm/helper"
+)
+
+func TestDefer(t *testing.T) {
+	m := ir.NewModule()
+	// each cleanup appends a digit to trace, the order they ran in
+	trace := m.NewGlobalDef("trace", CI32(0))
+	g := &EDeref{X: &EGlobal{G: trace}}
+	digit := func(d int64) Stmt {
+		return &SStore{Target: g, Expr: &EAdd{Lhs: &EMul{Lhs: g, Rhs: &EI32{V: 10}}, Rhs: &EI32{V: d}}}
+	}
+
+	thrower := newThrower(t, m, WithSSA())
+	// runs its cleanup on return
+	returns := m.NewFunc("returns", types.I32)
+	err := CompileFunc(returns, &SBlock{Stmts: []Stmt{
+		&SDefer{Body: digit(4)},
+		&SRet{Val: &EI32{V: 0}},
+	}}, WithSSA())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// runs finally on return
+	finally := m.NewFunc("finally", types.I32)
+	err = CompileFunc(finally, &STry{
+		Body:    &SRet{Val: &EI32{V: 0}},
+		Finally: digit(8),
+	}, WithSSA())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := m.NewFunc("main", types.I32)
+	err = CompileFunc(f, &SBlock{Stmts: []Stmt{
+		// 2 then 1
+		&SBlock{Stmts: []Stmt{
+			&SDefer{Body: digit(1)},
+			&SDefer{Body: digit(2)},
+		}},
+		&SWhile{Cond: &EBool{V: true}, Block: &SBlock{Stmts: []Stmt{
+			&SDefer{Body: digit(3)},
+			&SBreak{},
+		}}},
+		&SExpr{Expr: &ECall{Callee: &EFunc{F: returns}}},
+		// the exception unwinds through the cleanup 5 to the catch 6, then
+		// finally 7 runs
+		&STry{
+			Body: &SBlock{Stmts: []Stmt{
+				&SDefer{Body: digit(5)},
+				&SExpr{Expr: &ECall{Callee: &EFunc{F: thrower}, Args: []Expr{&EI32{V: 1}}}},
+				digit(9),
+			}},
+			Catches: []Catch{{Typ: types.I32, Body: digit(6)}},
+			Finally: digit(7),
+		},
+		&SExpr{Expr: &ECall{Callee: &EFunc{F: finally}}},
+		// exits with 0 when the trace is right
+		&SRet{Val: &ESub{Lhs: g, Rhs: &EI32{V: 21345678}}},
+	}}, WithSSA())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	PrettyPrint(m)
+
+	ExecuteIR(m)
+}
+
+func TestUnwindRelease(t *testing.T) {
+	for _, s := range []EHStrategy{EHItanium, EHSetjmp, EHErrorFlag} {
+		m := ir.NewModule()
+		// the destructor of counted objects only counts them, the runtime
+		// finds it by its name
+		counted := NewStruct(m, "counted", Field{Name: "p", Typ: TPtr(TI8)})
+		freed := m.NewGlobalDef("freed", CI64(0))
+		dtor := m.NewFunc("rc.dtor.counted", types.Void, ir.NewParam("p", TPtr(TI8)))
+		dtorB := dtor.NewBlock("")
+		dtorB.NewStore(dtorB.NewAdd(dtorB.NewLoad(TI64, freed), CI64(1)), freed)
+		dtorB.NewRet(nil)
+		thrower := newThrower(t, m, WithSSA(), WithExceptions(s))
+
+		f := m.NewFunc("main", types.I32)
+		err := CompileFunc(f, &SBlock{Stmts: []Stmt{
+			&SDefine{Name: "n", Expr: &EI64{V: 0}},
+			&STry{
+				Body: &SBlock{Stmts: []Stmt{
+					// not defined yet when the exception unwinds, not released
+					&SExpr{Expr: &ECall{Callee: &EFunc{F: thrower}, Args: []Expr{&EI32{V: 0}}}},
+					&SDefine{Name: "a", Expr: &ENew{Typ: counted.Typ}},
+					// the exception releases a on its way to the catch
+					&SExpr{Expr: &ECall{Callee: &EFunc{F: thrower}, Args: []Expr{&EI32{V: 1}}}},
+				}},
+				// before the catch frees the exception, with the portable
+				// runtime
+				Catches: []Catch{{Typ: types.I32, Body: &SAssign{Name: "n", Expr: &EDeref{X: &EGlobal{G: freed}}}}},
+			},
+			// exits with 0 when a was freed once
+			&SRet{Val: &ETrunc{X: &ESub{Lhs: &EVariable{Name: "n"}, Rhs: &EI64{V: 1}}, Typ: TI32}},
+		}}, WithSSA(), WithCollector(GCRefCount), WithExceptions(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		PrettyPrint(m)
+
+		ExecuteIR(m)
+	}
+}
@@ -0,0 +1,40 @@
+package controlflow
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/researchllvm/helper"
+)
+
+func TestFuncToDot(t *testing.T) {
+	f := ir.NewFunc("foo", types.Void)
+
+	err := CompileFunc(f, &SWhile{
+		Cond: &EBool{V: true},
+		Block: &SSwitch{
+			Target: &EI32{V: 1},
+			CaseList: []struct {
+				EConstant
+				Stmt
+			}{
+				{EConstant: &EI32{V: 1}, Stmt: &SDoWhile{
+					Cond:  &EBool{V: false},
+					Block: &SDefine{Name: "x", Typ: types.I32, Expr: &EI32{V: 1}},
+				}},
+				{EConstant: &EI32{V: 2}, Stmt: &SRet{Val: &EVoid{}}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dot, err := helper.FuncToDot(f, helper.HighlightLoops())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println(dot)
+}
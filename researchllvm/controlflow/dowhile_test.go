@@ -10,9 +10,8 @@ import (
 
 func TestDoWhile(t *testing.T) {
 	f := ir.NewFunc("foo", types.Void)
-	ctx := NewContext(f.NewBlock(""))
 
-	ctx.compileStmt(&SDoWhile{
+	err := CompileFunc(f, &SDoWhile{
 		Cond: &EBool{V: true},
 		Block: &SDefine{
 			Stmt: nil,
@@ -21,8 +20,9 @@ func TestDoWhile(t *testing.T) {
 			Expr: &EI32{V: 1},
 		},
 	})
-
-	f.Blocks[len(f.Blocks)-1].NewRet(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	fmt.Println(f.LLString())
 }
@@ -0,0 +1,211 @@
+package controlflow
+
+import (
+	"fmt"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/value"
+	"github.com/llir/researchllvm/eh"
+	. "github.com/llir/researchllvm/helper"
+)
+
+// handler is where the exceptions thrown in a scope go: the catch dispatch of
+// a try region, or the cleanups of a scope. Its entry block is entered with
+// the exception exc, from the landing pad of the scope or from the handlers of
+// the scopes nested in it that did not stop the exception.
+type handler struct {
+	ctx   *Context
+	lpad  *ir.Block
+	entry *ir.Block
+	exc   *ir.InstPhi
+}
+
+// tryRegion is the body of an STry with catches.
+type tryRegion struct {
+	catches []Catch
+	h       *handler
+}
+
+func (ctx *Context) newHandler(name string) *handler {
+	h := &handler{ctx: ctx, entry: ctx.newBlock(name)}
+	// ir.NewPhi takes the type from its first incoming value, which the phi
+	// does not have yet
+	h.exc = &ir.InstPhi{Typ: ctx.fn.lowering.excType(ctx.fn)}
+	h.entry.Insts = append(h.entry.Insts, h.exc)
+	// the nested handlers that continue in h are known when the function
+	// is done
+	ctx.fn.unsealed = append(ctx.fn.unsealed, h.entry)
+	return h
+}
+
+// unwindHandler returns the handler of the exceptions thrown in ctx, nil when
+// they leave the function.
+func (ctx *Context) unwindHandler() *handler {
+	for c := ctx; c != nil; c = c.parent {
+		if c.try != nil {
+			if c.try.h == nil {
+				c.try.h = c.newHandler("catch.dispatch")
+			}
+			return c.try.h
+		}
+		if c.hasCleanups() {
+			return c.cleanupHandler()
+		}
+	}
+	return nil
+}
+
+// hasCleanups reports whether an exception that unwinds through the scope
+// has to leave it: run its cleanups and release its owned variables.
+func (ctx *Context) hasCleanups() bool {
+	return len(ctx.cleanups) > 0 || len(ctx.owned) > 0
+}
+
+// cleanupHandler returns the handler that leaves the scope of ctx as it is so
+// far, like exitScopes does, and lets the exception go on. Calls made before a
+// cleanup is registered or a variable is defined do not run or release it, so
+// there is a handler for each size of the scope.
+func (ctx *Context) cleanupHandler() *handler {
+	n := ctx.size()
+	if h, ok := ctx.handlers[n]; ok {
+		return h
+	}
+	if ctx.handlers == nil {
+		ctx.handlers = make(map[scopeSize]*handler)
+	}
+	h := ctx.newHandler("cleanup")
+	ctx.handlers[n] = h
+	hctx := ctx.NewContext(h.entry)
+	hctx.exitScope(ctx, n)
+	if !hctx.HasTerminator() {
+		hctx.unwindFrom(ctx.parent, h.exc)
+	}
+	return h
+}
+
+// unwindFrom lets the exception exc go on from the end of ctx to the handler
+// of outer, or out of the function.
+func (ctx *Context) unwindFrom(outer *Context, exc value.Value) {
+	if next := outer.unwindHandler(); next != nil {
+		ctx.dispatchFrom(next, ctx.Block, exc)
+	} else {
+		ctx.fn.lowering.resume(ctx, exc)
+	}
+}
+
+// call calls callee, so that an exception thrown by it goes to its handler in
+// the function, see ehLowering.
+func (ctx *Context) call(callee value.Value, args ...value.Value) value.Value {
+	return ctx.fn.lowering.call(ctx, ctx.unwindHandler(), callee, args)
+}
+
+// dispatchFrom branches from b to the handler h with the exception exc.
+func (ctx *Context) dispatchFrom(h *handler, b *ir.Block, exc value.Value) {
+	h.exc.Incs = append(h.exc.Incs, ir.NewIncoming(exc, b))
+	b.NewBr(h.entry)
+}
+
+// runCleanups runs the first n cleanups of the scope c from ctx, which is c or
+// a scope nested in it, last registered first. Each runs in a scope of its own
+// in c, whose exits and exceptions run the cleanups registered before it only.
+func (ctx *Context) runCleanups(c *Context, n int) {
+	all := c.cleanups
+	defer func() { c.cleanups = all }()
+	for i := n - 1; i >= 0 && !ctx.HasTerminator(); i-- {
+		c.cleanups = all[:i]
+		cleanupCtx := c.NewContext(ctx.Block)
+		all[i](cleanupCtx)
+		cleanupCtx.leaveScope()
+		ctx.moveTo(cleanupCtx.Block)
+	}
+}
+
+// compileTry compiles the body of s as a try region and its catches, which
+// the catch dispatch compares by type. An exception that no catch matches
+// goes on to the handler around s. Finally is a cleanup of the scope of the
+// whole statement, it runs after the body or the catch, whichever way they
+// are left.
+func (ctx *Context) compileTry(s *STry) {
+	tryCtx := ctx.NewContext(ctx.Block)
+	if s.Finally != nil {
+		tryCtx.cleanups = append(tryCtx.cleanups, func(c *Context) {
+			c.compileStmt(s.Finally)
+		})
+	}
+	r := &tryRegion{catches: s.Catches}
+	regionCtx := tryCtx.NewContext(tryCtx.Block)
+	if len(s.Catches) > 0 {
+		regionCtx.try = r
+	}
+	// the body is a scope in the region, its cleanups run before a catch
+	bodyCtx := regionCtx.NewContext(regionCtx.Block)
+	bodyCtx.compileStmt(s.Body)
+	bodyCtx.leaveScope()
+	end := ctx.newBlock("try.end")
+	if !bodyCtx.HasTerminator() {
+		bodyCtx.NewBr(end)
+	}
+	if r.h != nil {
+		tryCtx.compileCatches(r, end)
+	}
+	tryCtx.moveTo(end)
+	tryCtx.seal(end)
+	tryCtx.leaveScope()
+	ctx.moveTo(tryCtx.Block)
+}
+
+func (ctx *Context) compileCatches(r *tryRegion, end *ir.Block) {
+	l := ctx.fn.lowering
+	b := r.h.entry
+	for _, c := range r.catches {
+		catchB := ctx.newBlock("catch")
+		if c.Typ == nil {
+			if c.Name != "" {
+				panic(fmt.Sprintf("catch-all cannot bind the exception to `%s`, it has no type", c.Name))
+			}
+			b.NewBr(catchB)
+			b = nil
+		} else {
+			next := ctx.newBlock("catch.next")
+			b.NewCondBr(l.matches(b, r.h.exc, c.Typ), catchB, next)
+			ctx.seal(next)
+			b = next
+		}
+		ctx.seal(catchB)
+		catchCtx := ctx.NewContext(catchB)
+		typ := c.Typ
+		if typ == nil {
+			typ = TI8
+		}
+		payload := l.beginCatch(catchCtx.Block, r.h.exc, typ)
+		// the catch ends however it is left
+		catchCtx.cleanups = append(catchCtx.cleanups, func(c *Context) {
+			l.endCatch(c.Block, r.h.exc)
+		})
+		if c.Name != "" {
+			catchCtx.defineVariable(c.Name, c.Typ, catchCtx.NewLoad(c.Typ, payload))
+		}
+		catchCtx.compileStmt(c.Body)
+		catchCtx.leaveScope()
+		if !catchCtx.HasTerminator() {
+			catchCtx.NewBr(end)
+		}
+		if b == nil {
+			// a catch-all, the catches after it are never reached
+			return
+		}
+	}
+	exitCtx := ctx.NewContext(b)
+	exitCtx.unwindFrom(ctx, r.h.exc)
+}
+
+// compileThrow copies the value of s into a new exception object and throws
+// it, typed by its type.
+func (ctx *Context) compileThrow(s *SThrow) {
+	ctx.fn.lowering.throw(ctx, ctx.compileExpr(s.Expr))
+}
+
+// eh returns the C++ runtime of the module.
+func (fc *funcContext) eh() *eh.Runtime {
+	return eh.Plugin(fc.module())
+}
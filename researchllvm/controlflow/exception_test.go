@@ -0,0 +1,97 @@
+package controlflow
+
+import (
+	"testing"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/researchllvm/eh"
+	. "github.com/llir/researchllvm/helper"
+)
+
+func TestTryCatch(t *testing.T) {
+	m := ir.NewModule()
+	thrower := newThrower(t, m, WithSSA())
+
+	f := m.NewFunc("main", types.I32)
+	throw := func(v int64) Stmt {
+		return &SExpr{Expr: &ECall{Callee: &EFunc{F: thrower}, Args: []Expr{&EI32{V: v}}}}
+	}
+	err := CompileFunc(f, &SBlock{Stmts: []Stmt{
+		&SDefine{Name: "r", Expr: &EI32{V: 0}},
+		&STry{
+			Body: &SBlock{Stmts: []Stmt{
+				// the inner try has no catch for i32, its exception goes on
+				// to the outer dispatch
+				&STry{
+					Body:    throw(42),
+					Catches: []Catch{{Typ: types.I64, Body: &SRet{Val: &EI32{V: 1}}}},
+				},
+				&SRet{Val: &EI32{V: 2}},
+			}},
+			Catches: []Catch{
+				{Typ: types.I8, Body: &SRet{Val: &EI32{V: 3}}},
+				{Typ: types.I32, Name: "e", Body: &SAssign{Name: "r", Expr: &EVariable{Name: "e"}}},
+			},
+		},
+		// exits with 0 when 42 was caught
+		&SRet{Val: &ESub{Lhs: &EVariable{Name: "r"}, Rhs: &EI32{V: 42}}},
+	}}, WithSSA())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	PrettyPrint(m)
+
+	ExecuteIR(m)
+}
+
+func TestTryCatchClass(t *testing.T) {
+	m := ir.NewModule()
+	base := NewStruct(m, "error", Field{Name: "code", Typ: types.I32})
+	derived := NewStruct(m, "io_error",
+		Field{Name: "error", Typ: base.Typ},
+		Field{Name: "fd", Typ: types.I32},
+	)
+	eh.Plugin(m).Inherit(derived.Typ, base.Typ)
+
+	f := m.NewFunc("main", types.I32)
+	err := CompileFunc(f, &SBlock{Stmts: []Stmt{
+		&SDefine{Name: "r", Expr: &EI32{V: 0}},
+		&STry{
+			Body: &SThrow{Expr: &EStructLit{Typ: derived, Fields: []FieldInit{
+				{Name: "error", Expr: &EStructLit{Typ: base, Fields: []FieldInit{{Name: "code", Expr: &EI32{V: 42}}}}},
+			}}},
+			// catches the io_error as its base
+			Catches: []Catch{{Typ: base.Typ, Name: "e", Body: &SAssign{
+				Name: "r",
+				Expr: &EField{X: &EVariable{Name: "e"}, Name: "code"},
+			}}},
+			// runs after the catch
+			Finally: &SAssign{Name: "r", Expr: &ESub{Lhs: &EVariable{Name: "r"}, Rhs: &EI32{V: 42}}},
+		},
+		// exits with 0 when 42 was caught
+		&SRet{Val: &EVariable{Name: "r"}},
+	}}, WithSSA())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	PrettyPrint(m)
+
+	ExecuteIR(m)
+}
+
+// newThrower compiles `thrower(x i32)`, which throws x when it is positive,
+// with opts.
+func newThrower(t *testing.T, m *ir.Module, opts ...Option) *ir.Func {
+	thrower := m.NewFunc("thrower", types.Void, ir.NewParam("x", types.I32))
+	err := CompileFunc(thrower, &SIf{
+		Cond: &ELessThan{Lhs: &EI32{V: 0}, Rhs: &EVariable{Name: "x"}},
+		Then: &SThrow{Expr: &EVariable{Name: "x"}},
+	}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return thrower
+}
@@ -0,0 +1,35 @@
+package controlflow
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/enum"
+	"github.com/llir/llvm/ir/types"
+)
+
+func TestFloat(t *testing.T) {
+	f := ir.NewFunc("foo", types.I32)
+
+	err := CompileFunc(f, &SBlock{Stmts: []Stmt{
+		&SDefine{Name: "x", Typ: types.Double, Expr: &EConvert{X: &EI32{V: 3}, Typ: types.Double}},
+		&SDefine{Name: "y", Typ: types.Double, Expr: &EDiv{
+			Lhs: &EMul{Lhs: &EVariable{Name: "x"}, Rhs: &EF64{V: 1.5}},
+			Rhs: &EConvert{X: &EF32{V: 0.5}, Typ: types.Double},
+			// this division only may use a reciprocal
+			FastMath: []enum.FastMathFlag{enum.FastMathFlagARcp},
+		}},
+		&SIf{
+			// true when y is NaN
+			Cond: &EFCmp{Pred: enum.FPredUNE, Lhs: &EVariable{Name: "y"}, Rhs: &EVariable{Name: "y"}},
+			Then: &SRet{Val: &EI32{V: -1}},
+		},
+		&SRet{Val: &EConvert{X: &ERem{Lhs: &EVariable{Name: "y"}, Rhs: &EF64{V: 2}}, Typ: types.I32}},
+	}}, WithFastMath(enum.FastMathFlagNNaN, enum.FastMathFlagNInf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Println(f.LLString())
+}
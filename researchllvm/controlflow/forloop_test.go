@@ -10,17 +10,17 @@ import (
 
 func TestForLoop(t *testing.T) {
 	f := ir.NewFunc("foo", types.Void)
-	ctx := NewContext(f.NewBlock(""))
 
-	ctx.compileStmt(&SForLoop{
+	err := CompileFunc(f, &SForLoop{
 		InitName: "x",
 		InitExpr: &EI32{V: 0},
 		Step:     &EAdd{Lhs: &EVariable{Name: "x"}, Rhs: &EI32{V: 1}},
 		Cond:     &ELessThan{Lhs: &EVariable{Name: "x"}, Rhs: &EI32{V: 10}},
 		Block:    &SDefine{Name: "foo", Typ: types.I32, Expr: &EI32{V: 2}},
 	})
-
-	f.Blocks[len(f.Blocks)-1].NewRet(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	fmt.Println(f.LLString())
 }
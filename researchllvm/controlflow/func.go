@@ -0,0 +1,245 @@
+package controlflow
+
+import (
+	"fmt"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/enum"
+	"github.com/llir/llvm/ir/types"
+	. "github.com/llir/researchllvm/helper"
+)
+
+// Option configures how CompileFunc compiles a function.
+type Option func(fc *funcContext)
+
+// WithSSA makes variables SSA values, phis are placed while compiling instead
+// of leaving alloca, load and store for `opt -mem2reg`.
+func WithSSA() Option {
+	return func(fc *funcContext) {
+		fc.ssa = newSSABuilder(fc)
+	}
+}
+
+// WithFastMath sets fast-math flags on all float operations of the function
+// that do not set their own.
+func WithFastMath(flags ...enum.FastMathFlag) Option {
+	return func(fc *funcContext) {
+		fc.fastMath = flags
+	}
+}
+
+// WithCollector allocates the memory of ENew with the collector s. With
+// GCShadowStack, pointer variables are stack slots registered as roots, see
+// helper.ShadowStackRoots, and so are the environments of closure variables
+// and the boxes of variables captured by reference.
+//
+// The environments and boxes of escaping lambdas are on the heap too.
+// GCRefCount rejects escaping lambdas that capture variables, closures are not
+// counted; with GCNone they are never freed.
+func WithCollector(s GCStrategy) Option {
+	return func(fc *funcContext) {
+		fc.gc = s
+	}
+}
+
+// CompileFunc compiles body as the whole body of f. The named parameters of f
+// are variables of body.
+//
+// The function is finished afterwards: a block that falls off the end gets an
+// implicit `ret void` when f returns void, unreachable and empty blocks are
+// removed.
+//
+// All functions of a module must use the same exception strategy, see
+// WithExceptions.
+func CompileFunc(f *ir.Func, body Stmt, opts ...Option) error {
+	return compileFunc(f, body, func(ctx *Context) {
+		for _, param := range f.Params {
+			if param.Name() != "" {
+				ctx.defineVariable(param.Name(), param.Typ, param)
+			}
+		}
+	}, opts)
+}
+
+// compileFunc compiles body as the whole body of f, after prologue defines
+// the variables body starts with.
+func compileFunc(f *ir.Func, body Stmt, prologue func(ctx *Context), opts []Option) error {
+	ctx := NewContext(f.NewBlock(""))
+	ctx.fn.opts = opts
+	for _, param := range f.Params {
+		ctx.fn.used[param.Name()] = true
+	}
+	for _, opt := range opts {
+		opt(ctx.fn)
+	}
+	if f.Parent != nil && (ctx.fn.strategySet || throws(body)) {
+		if err := useStrategy(f.Parent, ctx.fn.strategy); err != nil {
+			return fmt.Errorf("function `%s`: %v", f.Name(), err)
+		}
+	}
+	if ctx.fn.ssa != nil {
+		ctx.fn.addressTaken = addressTaken(body)
+	}
+	ctx.fn.closures = analyzeClosures(body)
+	ctx.seal(ctx.Block)
+	if d := ctx.fn.debug; d != nil {
+		d.sp.Line = posOf(body).Line
+		d.sp.ScopeLine = posOf(body).Line
+		// the epilogue belongs to the function as a whole
+		defer d.attach(posOf(body))
+	}
+	ctx.fn.lowering.enterFunc(ctx, body)
+	if prologue != nil {
+		prologue(ctx)
+	}
+	ctx.compileStmt(body)
+	ctx.leaveScope()
+	ctx.fn.lowering.finishFunc(ctx)
+	if ctx.fn.err != nil {
+		return ctx.fn.err
+	}
+	for _, b := range ctx.fn.unsealed {
+		ctx.seal(b)
+	}
+	if err := finishFunc(f); err != nil {
+		return err
+	}
+	if ctx.fn.gc == GCShadowStack {
+		ShadowStackRoots(f)
+	}
+	return nil
+}
+
+func finishFunc(f *ir.Func) error {
+	removeUnreachableBlocks(f)
+	for _, b := range f.Blocks {
+		if b.Term != nil {
+			continue
+		}
+		if !f.Sig.RetType.Equal(types.Void) {
+			return fmt.Errorf("function `%s` can reach its end without returning a value of type %s", f.Name(), f.Sig.RetType)
+		}
+		b.NewRet(nil)
+	}
+	removeEmptyBlocks(f)
+	return nil
+}
+
+// removeUnreachableBlocks removes blocks that cannot be reached from the entry
+// block, and their incoming values from phi instructions.
+func removeUnreachableBlocks(f *ir.Func) {
+	if len(f.Blocks) == 0 {
+		return
+	}
+	reachable := map[*ir.Block]bool{}
+	work := []*ir.Block{f.Blocks[0]}
+	for len(work) > 0 {
+		b := work[len(work)-1]
+		work = work[:len(work)-1]
+		if reachable[b] {
+			continue
+		}
+		reachable[b] = true
+		if b.Term != nil {
+			work = append(work, b.Term.Succs()...)
+		}
+	}
+	blocks := f.Blocks[:0]
+	for _, b := range f.Blocks {
+		if reachable[b] {
+			blocks = append(blocks, b)
+		}
+	}
+	f.Blocks = blocks
+	for _, b := range f.Blocks {
+		for _, inst := range b.Insts {
+			if phi, ok := inst.(*ir.InstPhi); ok {
+				incs := phi.Incs[:0]
+				for _, inc := range phi.Incs {
+					if pred, ok := inc.Pred.(*ir.Block); ok && reachable[pred] {
+						incs = append(incs, inc)
+					}
+				}
+				phi.Incs = incs
+			}
+		}
+	}
+}
+
+// removeEmptyBlocks removes blocks that contain nothing but an unconditional
+// branch, their predecessors jump to the branch target directly.
+func removeEmptyBlocks(f *ir.Func) {
+	forward := map[*ir.Block]*ir.Block{}
+	for _, b := range f.Blocks[1:] {
+		br, ok := b.Term.(*ir.TermBr)
+		if !ok || len(b.Insts) != 0 {
+			continue
+		}
+		target := br.Target.(*ir.Block)
+		// a phi in the target distinguishes its predecessors, so the block
+		// cannot simply disappear
+		if target == b || hasPhi(target) {
+			continue
+		}
+		forward[b] = target
+	}
+	resolve := func(b *ir.Block) *ir.Block {
+		seen := map[*ir.Block]bool{}
+		for t := b; ; t = forward[t] {
+			if seen[t] {
+				// a cycle of empty blocks is an infinite loop, keep it as is
+				return b
+			}
+			if forward[t] == nil {
+				return t
+			}
+			seen[t] = true
+		}
+	}
+	blocks := f.Blocks[:0]
+	for _, b := range f.Blocks {
+		if forward[b] != nil && resolve(b) != b {
+			continue
+		}
+		blocks = append(blocks, b)
+		// the terminators cache their successors, which are computed again
+		// from the new targets
+		switch term := b.Term.(type) {
+		case *ir.TermBr:
+			term.Target = resolve(term.Target.(*ir.Block))
+			term.Successors = nil
+		case *ir.TermCondBr:
+			term.TargetTrue = resolve(term.TargetTrue.(*ir.Block))
+			term.TargetFalse = resolve(term.TargetFalse.(*ir.Block))
+			term.Successors = nil
+		case *ir.TermSwitch:
+			term.TargetDefault = resolve(term.TargetDefault.(*ir.Block))
+			for _, c := range term.Cases {
+				c.Target = resolve(c.Target.(*ir.Block))
+			}
+			term.Successors = nil
+		case *ir.TermInvoke:
+			term.NormalRetTarget = resolve(term.NormalRetTarget.(*ir.Block))
+			term.Successors = nil
+		}
+	}
+	f.Blocks = blocks
+}
+
+func hasPhi(b *ir.Block) bool {
+	for _, inst := range b.Insts {
+		if _, ok := inst.(*ir.InstPhi); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func moveBlockToEnd(f *ir.Func, b *ir.Block) {
+	for i, block := range f.Blocks {
+		if block == b {
+			f.Blocks = append(append(f.Blocks[:i:i], f.Blocks[i+1:]...), b)
+			return
+		}
+	}
+}
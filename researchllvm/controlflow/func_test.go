@@ -0,0 +1,62 @@
+package controlflow
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/types"
+)
+
+func TestImplicitReturn(t *testing.T) {
+	f := ir.NewFunc("foo", types.Void)
+
+	// `if.else` and `leave.if` only branch onward and are removed,
+	// `leave.while.loop` gets the implicit `ret void`
+	err := CompileFunc(f, &SWhile{
+		Cond: &EBool{V: true},
+		Block: &SIf{
+			Cond: &EBool{V: false},
+			Then: &SBreak{},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Println(f.LLString())
+}
+
+func TestMissingReturn(t *testing.T) {
+	f := ir.NewFunc("foo", types.I32)
+
+	err := CompileFunc(f, &SIf{
+		Cond: &EBool{V: true},
+		Then: &SRet{Val: &EI32{V: 1}},
+	})
+	if err == nil {
+		t.Fatal("expected an error for falling off the end of a non-void function")
+	}
+
+	fmt.Println(err)
+}
+
+func TestParams(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithSSA()}} {
+		f := ir.NewFunc("max", types.I32, ir.NewParam("a", types.I32), ir.NewParam("b", types.I32))
+
+		// the parameters are variables, b can be assigned to
+		err := CompileFunc(f, &SBlock{Stmts: []Stmt{
+			&SIf{
+				Cond: &ELessThan{Lhs: &EVariable{Name: "b"}, Rhs: &EVariable{Name: "a"}},
+				Then: &SAssign{Name: "b", Expr: &EVariable{Name: "a"}},
+			},
+			&SRet{Val: &EVariable{Name: "b"}},
+		}}, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fmt.Println(f.LLString())
+	}
+}
@@ -0,0 +1,107 @@
+package controlflow
+
+import (
+	"testing"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/types"
+	. "github.com/llir/researchllvm/helper"
+)
+
+func TestShadowStackGC(t *testing.T) {
+	m := ir.NewModule()
+	f := m.NewFunc("main", types.I32)
+
+	kept := &EVariable{Name: "kept"}
+	i := &EVariable{Name: "i"}
+	err := CompileFunc(f, &SBlock{Stmts: []Stmt{
+		&SDefine{Name: "kept", Typ: TPtr(TI64)},
+		&SDefine{Name: "i", Typ: TI64, Expr: &EI64{V: 0}},
+		// about 12MB in total, the collector frees all but the kept arrays
+		&SWhile{
+			Cond: &ELessThan{Lhs: i, Rhs: &EI64{V: 100000}},
+			Block: &SBlock{Stmts: []Stmt{
+				&SDefine{Name: "p", Expr: &ENew{Typ: TI64, Len: &EI64{V: 16}}},
+				&SStore{Target: &EIndex{X: &EVariable{Name: "p"}, Index: &EI64{V: 0}}, Expr: i},
+				&SIf{
+					Cond: &ELessThan{Lhs: &ERem{Lhs: i, Rhs: &EI64{V: 1000}}, Rhs: &EI64{V: 1}},
+					Then: &SAssign{Name: "kept", Expr: &EVariable{Name: "p"}},
+				},
+				&SAssign{Name: "i", Expr: &EAdd{Lhs: i, Rhs: &EI64{V: 1}}},
+			}},
+		},
+		// kept is a root, its array was not freed and reused
+		&SIf{
+			Cond: &ELessThan{Lhs: &EIndex{X: kept, Index: &EI64{V: 0}}, Rhs: &EI64{V: 99000}},
+			Then: &SRet{Val: &EI32{V: 1}},
+		},
+		&SIf{
+			Cond: &ELessThan{Lhs: &EI64{V: 99000}, Rhs: &EIndex{X: kept, Index: &EI64{V: 0}}},
+			Then: &SRet{Val: &EI32{V: 1}},
+		},
+		&SRet{Val: &EI32{V: 0}},
+	}}, WithSSA(), WithCollector(GCShadowStack))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.GC != "shadow-stack" {
+		t.Errorf("expected the shadow stack, got `%s`", f.GC)
+	}
+
+	PrettyPrint(m)
+
+	ExecuteIR(m, GCRuntime())
+}
+
+func TestShadowStackClosure(t *testing.T) {
+	m := ir.NewModule()
+	n := &EVariable{Name: "n"}
+	closure := types.NewStruct(TPtr(TI8), TPtr(types.NewFunc(types.I64, TPtr(TI8))))
+
+	// the closure outlives counter, its environment and the box of n are on
+	// the heap
+	counter := m.NewFunc("counter", closure)
+	err := CompileFunc(counter, &SBlock{Stmts: []Stmt{
+		&SDefine{Name: "n", Expr: &EI64{V: 0}},
+		&SRet{Val: &ELambda{
+			RetType: types.I64,
+			ByRef:   []string{"n"},
+			Body: &SBlock{Stmts: []Stmt{
+				&SAssign{Name: "n", Expr: &EAdd{Lhs: n, Rhs: &EI64{V: 1}}},
+				// collects while the environment is only held by the caller
+				&SExpr{Expr: &ENew{Typ: TI64, Len: &EI64{V: 1 << 18}}},
+				&SRet{Val: n},
+			}},
+		}},
+	}}, WithSSA(), WithCollector(GCShadowStack))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := m.NewFunc("main", types.I32)
+	c := &EVariable{Name: "c"}
+	i := &EVariable{Name: "i"}
+	err = CompileFunc(f, &SBlock{Stmts: []Stmt{
+		&SDefine{Name: "c", Expr: &ECall{Callee: &EFunc{F: counter}}},
+		&SDefine{Name: "i", Typ: TI64, Expr: &EI64{V: 0}},
+		// the collector runs while c is live, and objects of the size of
+		// the environment and the box take the memory it frees
+		&SWhile{
+			Cond: &ELessThan{Lhs: i, Rhs: &EI64{V: 300000}},
+			Block: &SBlock{Stmts: []Stmt{
+				&SStore{Target: &EDeref{X: &ENew{Typ: TI64}}, Expr: &EI64{V: 1000}},
+				&SAssign{Name: "i", Expr: &EAdd{Lhs: i, Rhs: &EI64{V: 1}}},
+			}},
+		},
+		&SExpr{Expr: &ECall{Callee: c}},
+		// exits with 0 when the environment and n survived, 2 calls
+		&SRet{Val: &ETrunc{X: &ESub{Lhs: &ECall{Callee: c}, Rhs: &EI64{V: 2}}, Typ: TI32}},
+	}}, WithSSA(), WithCollector(GCShadowStack))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	PrettyPrint(m)
+
+	ExecuteIR(m, GCRuntime())
+}
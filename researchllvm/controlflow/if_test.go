@@ -10,13 +10,15 @@ import (
 
 func TestParameterAttr(t *testing.T) {
 	f := ir.NewFunc("foo", types.Void)
-	ctx := NewContext(f.NewBlock(""))
 
-	ctx.compileStmt(&SIf{
+	err := CompileFunc(f, &SIf{
 		Cond: &EBool{V: true},
 		Then: &SRet{Val: &EVoid{}},
 		Else: &SRet{Val: &EVoid{}},
 	})
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	fmt.Println(f.LLString())
 }
@@ -26,15 +28,12 @@ func TestParameterAttr(t *testing.T) {
 // ```
 // define void @foo() {
 // ; <label>:0
-// br i1 true, label %1, label %2
+// br i1 true, label %if.then, label %if.else
 //
-// ; <label>:1
-// br label %3
-//
-// ; <label>:2
+// if.then:
 // ret void
 //
-// ; <label>:3
+// if.else:
 // ret void
 // }
 // ```
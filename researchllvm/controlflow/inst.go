@@ -0,0 +1,294 @@
+package controlflow
+
+import (
+	"fmt"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/value"
+)
+
+// operands returns the value operands of the instruction or terminator inst,
+// as pointers so that they can be replaced. Branch targets are operands too.
+func operands(inst interface{}) []*value.Value {
+	switch inst := inst.(type) {
+	// aggregate
+	case *ir.InstExtractValue:
+		return []*value.Value{&inst.X}
+	case *ir.InstInsertValue:
+		return []*value.Value{&inst.X, &inst.Elem}
+	// binary and bitwise
+	case *ir.InstAdd:
+		return []*value.Value{&inst.X, &inst.Y}
+	case *ir.InstFAdd:
+		return []*value.Value{&inst.X, &inst.Y}
+	case *ir.InstSub:
+		return []*value.Value{&inst.X, &inst.Y}
+	case *ir.InstFSub:
+		return []*value.Value{&inst.X, &inst.Y}
+	case *ir.InstMul:
+		return []*value.Value{&inst.X, &inst.Y}
+	case *ir.InstFMul:
+		return []*value.Value{&inst.X, &inst.Y}
+	case *ir.InstUDiv:
+		return []*value.Value{&inst.X, &inst.Y}
+	case *ir.InstSDiv:
+		return []*value.Value{&inst.X, &inst.Y}
+	case *ir.InstFDiv:
+		return []*value.Value{&inst.X, &inst.Y}
+	case *ir.InstURem:
+		return []*value.Value{&inst.X, &inst.Y}
+	case *ir.InstSRem:
+		return []*value.Value{&inst.X, &inst.Y}
+	case *ir.InstFRem:
+		return []*value.Value{&inst.X, &inst.Y}
+	case *ir.InstShl:
+		return []*value.Value{&inst.X, &inst.Y}
+	case *ir.InstLShr:
+		return []*value.Value{&inst.X, &inst.Y}
+	case *ir.InstAShr:
+		return []*value.Value{&inst.X, &inst.Y}
+	case *ir.InstAnd:
+		return []*value.Value{&inst.X, &inst.Y}
+	case *ir.InstOr:
+		return []*value.Value{&inst.X, &inst.Y}
+	case *ir.InstXor:
+		return []*value.Value{&inst.X, &inst.Y}
+	case *ir.InstFNeg:
+		return []*value.Value{&inst.X}
+	// conversion
+	case *ir.InstTrunc:
+		return []*value.Value{&inst.From}
+	case *ir.InstZExt:
+		return []*value.Value{&inst.From}
+	case *ir.InstSExt:
+		return []*value.Value{&inst.From}
+	case *ir.InstFPTrunc:
+		return []*value.Value{&inst.From}
+	case *ir.InstFPExt:
+		return []*value.Value{&inst.From}
+	case *ir.InstFPToUI:
+		return []*value.Value{&inst.From}
+	case *ir.InstFPToSI:
+		return []*value.Value{&inst.From}
+	case *ir.InstUIToFP:
+		return []*value.Value{&inst.From}
+	case *ir.InstSIToFP:
+		return []*value.Value{&inst.From}
+	case *ir.InstPtrToInt:
+		return []*value.Value{&inst.From}
+	case *ir.InstIntToPtr:
+		return []*value.Value{&inst.From}
+	case *ir.InstBitCast:
+		return []*value.Value{&inst.From}
+	case *ir.InstAddrSpaceCast:
+		return []*value.Value{&inst.From}
+	// memory
+	case *ir.InstAlloca:
+		if inst.NElems == nil {
+			return nil
+		}
+		return []*value.Value{&inst.NElems}
+	case *ir.InstLoad:
+		return []*value.Value{&inst.Src}
+	case *ir.InstStore:
+		return []*value.Value{&inst.Src, &inst.Dst}
+	case *ir.InstFence:
+		return nil
+	case *ir.InstCmpXchg:
+		return []*value.Value{&inst.Ptr, &inst.Cmp, &inst.New}
+	case *ir.InstAtomicRMW:
+		return []*value.Value{&inst.Dst, &inst.X}
+	case *ir.InstGetElementPtr:
+		ops := []*value.Value{&inst.Src}
+		for i := range inst.Indices {
+			ops = append(ops, &inst.Indices[i])
+		}
+		return ops
+	// vector
+	case *ir.InstExtractElement:
+		return []*value.Value{&inst.X, &inst.Index}
+	case *ir.InstInsertElement:
+		return []*value.Value{&inst.X, &inst.Elem, &inst.Index}
+	case *ir.InstShuffleVector:
+		return []*value.Value{&inst.X, &inst.Y, &inst.Mask}
+	// other
+	case *ir.InstICmp:
+		return []*value.Value{&inst.X, &inst.Y}
+	case *ir.InstFCmp:
+		return []*value.Value{&inst.X, &inst.Y}
+	case *ir.InstPhi:
+		var ops []*value.Value
+		for _, inc := range inst.Incs {
+			ops = append(ops, &inc.X, &inc.Pred)
+		}
+		return ops
+	case *ir.InstSelect:
+		return []*value.Value{&inst.Cond, &inst.ValueTrue, &inst.ValueFalse}
+	case *ir.InstFreeze:
+		return []*value.Value{&inst.X}
+	case *ir.InstCall:
+		return append([]*value.Value{&inst.Callee}, argOperands(inst.Args)...)
+	case *ir.InstVAArg:
+		return []*value.Value{&inst.ArgList}
+	case *ir.InstLandingPad:
+		return nil
+	// terminators
+	case *ir.TermRet:
+		if inst.X == nil {
+			return nil
+		}
+		return []*value.Value{&inst.X}
+	case *ir.TermBr:
+		return []*value.Value{&inst.Target}
+	case *ir.TermCondBr:
+		return []*value.Value{&inst.Cond, &inst.TargetTrue, &inst.TargetFalse}
+	case *ir.TermSwitch:
+		ops := []*value.Value{&inst.X, &inst.TargetDefault}
+		for _, c := range inst.Cases {
+			ops = append(ops, &c.Target)
+		}
+		return ops
+	case *ir.TermInvoke:
+		ops := append([]*value.Value{&inst.Invokee}, argOperands(inst.Args)...)
+		return append(ops, &inst.NormalRetTarget, &inst.ExceptionRetTarget)
+	case *ir.TermResume:
+		return []*value.Value{&inst.X}
+	case *ir.TermUnreachable:
+		return nil
+	}
+	panic(fmt.Sprintf("operands of %T are not supported", inst))
+}
+
+func argOperands(args []value.Value) []*value.Value {
+	var ops []*value.Value
+	for i := range args {
+		ops = append(ops, &args[i])
+	}
+	return ops
+}
+
+// attachments returns the metadata attachments of the instruction or
+// terminator inst, to add to them.
+func attachments(inst interface{}) *ir.Metadata {
+	switch inst := inst.(type) {
+	case *ir.InstExtractValue:
+		return &inst.Metadata
+	case *ir.InstInsertValue:
+		return &inst.Metadata
+	case *ir.InstAdd:
+		return &inst.Metadata
+	case *ir.InstFAdd:
+		return &inst.Metadata
+	case *ir.InstSub:
+		return &inst.Metadata
+	case *ir.InstFSub:
+		return &inst.Metadata
+	case *ir.InstMul:
+		return &inst.Metadata
+	case *ir.InstFMul:
+		return &inst.Metadata
+	case *ir.InstUDiv:
+		return &inst.Metadata
+	case *ir.InstSDiv:
+		return &inst.Metadata
+	case *ir.InstFDiv:
+		return &inst.Metadata
+	case *ir.InstURem:
+		return &inst.Metadata
+	case *ir.InstSRem:
+		return &inst.Metadata
+	case *ir.InstFRem:
+		return &inst.Metadata
+	case *ir.InstShl:
+		return &inst.Metadata
+	case *ir.InstLShr:
+		return &inst.Metadata
+	case *ir.InstAShr:
+		return &inst.Metadata
+	case *ir.InstAnd:
+		return &inst.Metadata
+	case *ir.InstOr:
+		return &inst.Metadata
+	case *ir.InstXor:
+		return &inst.Metadata
+	case *ir.InstFNeg:
+		return &inst.Metadata
+	case *ir.InstTrunc:
+		return &inst.Metadata
+	case *ir.InstZExt:
+		return &inst.Metadata
+	case *ir.InstSExt:
+		return &inst.Metadata
+	case *ir.InstFPTrunc:
+		return &inst.Metadata
+	case *ir.InstFPExt:
+		return &inst.Metadata
+	case *ir.InstFPToUI:
+		return &inst.Metadata
+	case *ir.InstFPToSI:
+		return &inst.Metadata
+	case *ir.InstUIToFP:
+		return &inst.Metadata
+	case *ir.InstSIToFP:
+		return &inst.Metadata
+	case *ir.InstPtrToInt:
+		return &inst.Metadata
+	case *ir.InstIntToPtr:
+		return &inst.Metadata
+	case *ir.InstBitCast:
+		return &inst.Metadata
+	case *ir.InstAddrSpaceCast:
+		return &inst.Metadata
+	case *ir.InstAlloca:
+		return &inst.Metadata
+	case *ir.InstLoad:
+		return &inst.Metadata
+	case *ir.InstStore:
+		return &inst.Metadata
+	case *ir.InstFence:
+		return &inst.Metadata
+	case *ir.InstCmpXchg:
+		return &inst.Metadata
+	case *ir.InstAtomicRMW:
+		return &inst.Metadata
+	case *ir.InstGetElementPtr:
+		return &inst.Metadata
+	case *ir.InstExtractElement:
+		return &inst.Metadata
+	case *ir.InstInsertElement:
+		return &inst.Metadata
+	case *ir.InstShuffleVector:
+		return &inst.Metadata
+	case *ir.InstICmp:
+		return &inst.Metadata
+	case *ir.InstFCmp:
+		return &inst.Metadata
+	case *ir.InstPhi:
+		return &inst.Metadata
+	case *ir.InstSelect:
+		return &inst.Metadata
+	case *ir.InstFreeze:
+		return &inst.Metadata
+	case *ir.InstCall:
+		return &inst.Metadata
+	case *ir.InstVAArg:
+		return &inst.Metadata
+	case *ir.InstLandingPad:
+		return &inst.Metadata
+	case *ir.TermRet:
+		return &inst.Metadata
+	case *ir.TermBr:
+		return &inst.Metadata
+	case *ir.TermCondBr:
+		return &inst.Metadata
+	case *ir.TermSwitch:
+		return &inst.Metadata
+	case *ir.TermInvoke:
+		return &inst.Metadata
+	case *ir.TermResume:
+		return &inst.Metadata
+	case *ir.TermUnreachable:
+		return &inst.Metadata
+	}
+	panic(fmt.Sprintf("attachments of %T are not supported", inst))
+}
@@ -0,0 +1,52 @@
+package controlflow
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/types"
+	. "github.com/llir/researchllvm/helper"
+)
+
+func TestIntegerWidth(t *testing.T) {
+	f := ir.NewFunc("foo", TU32)
+
+	err := CompileFunc(f, &SBlock{Stmts: []Stmt{
+		// widened by sext, the constant is signed
+		&SDefine{Name: "x", Typ: TI64, Expr: &EI8{V: -1}},
+		// widened by zext, the constant is unsigned
+		&SDefine{Name: "y", Typ: TU32, Expr: &EU8{V: 255}},
+		&SIf{
+			// y is zero extended to i64 and compared signed, as x is the wider
+			Cond: &ELessThan{Lhs: &EVariable{Name: "y"}, Rhs: &EVariable{Name: "x"}},
+			Then: &SRet{Val: &EU32{V: 0}},
+		},
+		// udiv and lshr, both operands are unsigned
+		&SRet{Val: &EShr{
+			Lhs: &EDiv{Lhs: &EVariable{Name: "y"}, Rhs: &EU32{V: 3}},
+			Rhs: &EU32{V: 1},
+		}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Println(f.LLString())
+}
+
+func TestIntegerCast(t *testing.T) {
+	f := ir.NewFunc("foo", TI8)
+
+	err := CompileFunc(f, &SBlock{Stmts: []Stmt{
+		&SDefine{Name: "x", Typ: TU16, Expr: &EZExt{X: &EU8{V: 200}, Typ: TU16}},
+		// uitofp as x is unsigned, then fptosi to the signed i32
+		&SDefine{Name: "y", Typ: TI32, Expr: &EConvert{X: &EConvert{X: &EVariable{Name: "x"}, Typ: types.Double}, Typ: TI32}},
+		&SRet{Val: &ETrunc{X: &EVariable{Name: "y"}, Typ: TI8}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Println(f.LLString())
+}
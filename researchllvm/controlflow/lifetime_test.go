@@ -0,0 +1,40 @@
+package controlflow
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/types"
+)
+
+func TestLifetime(t *testing.T) {
+	m := ir.NewModule()
+	f := m.NewFunc("foo", types.I32)
+
+	err := CompileFunc(f, &SBlock{Stmts: []Stmt{
+		&SDefine{Name: "buf", Typ: types.NewArray(1024, types.I32)},
+		&SWhile{
+			Cond: &EBool{V: true},
+			Block: &SBlock{Stmts: []Stmt{
+				&SDefine{Name: "tmp", Typ: types.NewArray(1024, types.I32)},
+				&SIf{
+					Cond: &EBool{V: false},
+					// ends `tmp` before leaving the loop
+					Then: &SBreak{},
+				},
+				&SIf{
+					Cond: &EBool{V: false},
+					// ends `tmp` and `buf` before returning
+					Then: &SRet{Val: &EI32{V: 1}},
+				},
+			}},
+		},
+		&SRet{Val: &EI32{V: 0}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Println(m)
+}
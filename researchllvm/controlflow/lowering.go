@@ -0,0 +1,392 @@
+package controlflow
+
+import (
+	"fmt"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/enum"
+	"github.com/llir/llvm/ir/metadata"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+	"github.com/llir/researchllvm/eh"
+	. "github.com/llir/researchllvm/helper"
+)
+
+// EHStrategy is how exceptions are lowered: how a thrown exception gets to its
+// handler, and how the handler tells what it caught. The handlers, the catch
+// dispatch and the cleanups are the same with each, and so is the behavior
+// of the program. All functions of a program use the same strategy.
+type EHStrategy int
+
+const (
+	// EHItanium is zero-cost exception handling: calls that may throw into
+	// a handler are invokes, and the unwinder of the C++ runtime finds their
+	// landing pads. Nothing is done unless an exception is thrown.
+	EHItanium EHStrategy = iota
+	// EHSetjmp pushes a frame with a jmp_buf in each function that has
+	// handlers, and a throw longjmps to the last one pushed. The calls
+	// record where they are, to find the handler once back in the function.
+	// The variables of such functions live in memory, which longjmp does not
+	// roll back.
+	EHSetjmp
+	// EHErrorFlag returns from a function that throws as if nothing happened,
+	// with the exception in a global that every call checks afterwards.
+	EHErrorFlag
+)
+
+var strategyNames = [...]string{
+	EHItanium:   "itanium",
+	EHSetjmp:    "setjmp",
+	EHErrorFlag: "errorflag",
+}
+
+func (s EHStrategy) String() string {
+	if s < 0 || int(s) >= len(strategyNames) {
+		return fmt.Sprintf("EHStrategy(%d)", int(s))
+	}
+	return strategyNames[s]
+}
+
+// WithExceptions lowers exceptions with the strategy s, EHItanium by default.
+// EHSetjmp and EHErrorFlag do not need the C++ runtime, see
+// eh.PortablePlugin. The module records the strategy of the first function
+// that is given one, or that throws, catches or defers. CompileFunc fails for
+// such a function of the module that uses another strategy.
+func WithExceptions(s EHStrategy) Option {
+	return func(fc *funcContext) {
+		fc.strategy = s
+		fc.strategySet = true
+		switch s {
+		case EHItanium:
+			fc.lowering = &itaniumLowering{}
+		case EHSetjmp:
+			fc.lowering = &setjmpLowering{}
+		case EHErrorFlag:
+			fc.lowering = &errorFlagLowering{}
+		default:
+			panic(fmt.Sprintf("unknown exception strategy %d", s))
+		}
+	}
+}
+
+// throws reports whether body throws, catches or defers, which depends on the
+// exception strategy.
+func throws(body Stmt) bool {
+	found := false
+	inspect(body, func(s Stmt) {
+		switch s.(type) {
+		case *STry, *SThrow, *SDefer:
+			found = true
+		}
+	}, nil)
+	return found
+}
+
+// useStrategy records s as the exception strategy of mod, in the named metadata
+// `!controlflow.eh`. The functions of a module call each other and throw to
+// each other, so it fails when mod uses another strategy already.
+func useStrategy(mod *ir.Module, s EHStrategy) error {
+	if def, ok := mod.NamedMetadataDefs["controlflow.eh"]; ok {
+		used := def.Nodes[0].(*metadata.Tuple).Fields[0].(*metadata.String).Value
+		if used != s.String() {
+			return fmt.Errorf("cannot lower exceptions with %s, the module uses %s", s, used)
+		}
+		return nil
+	}
+	if mod.NamedMetadataDefs == nil {
+		mod.NamedMetadataDefs = make(map[string]*metadata.NamedDef)
+	}
+	name := &metadata.Tuple{MetadataID: -1, Fields: []metadata.Field{&metadata.String{Value: s.String()}}}
+	mod.MetadataDefs = append(mod.MetadataDefs, name)
+	def := &metadata.NamedDef{Name: "controlflow.eh", Nodes: []metadata.Node{name}}
+	mod.NamedMetadataDefs[def.Name] = def
+	return nil
+}
+
+// ehLowering lowers exceptions for an EHStrategy, one per compiled function.
+// The handlers pass on the exception as a value exc of excType.
+type ehLowering interface {
+	excType(fc *funcContext) types.Type
+	// enterFunc prepares ctx, the scope of the function body about to be
+	// compiled
+	enterFunc(ctx *Context, body Stmt)
+	// finishFunc completes the function once all handlers are known
+	finishFunc(ctx *Context)
+	// call calls callee, an exception it throws goes to h, or out of the
+	// function when h is nil
+	call(ctx *Context, h *handler, callee value.Value, args []value.Value) value.Value
+	// throw throws v from ctx, ctx ends there
+	throw(ctx *Context, v value.Value)
+	// resume lets exc go on out of the function, ctx ends there
+	resume(ctx *Context, exc value.Value)
+	// matches reports whether exc is caught as type t
+	matches(b *ir.Block, exc value.Value, t types.Type) value.Value
+	// beginCatch starts to handle exc, caught as type t, and returns a t* to
+	// its value
+	beginCatch(b *ir.Block, exc value.Value, t types.Type) value.Value
+	// endCatch ends the handler of exc
+	endCatch(b *ir.Block, exc value.Value)
+}
+
+// itaniumLowering lowers to invoke and landingpad with the C++ runtime.
+type itaniumLowering struct{}
+
+func (itaniumLowering) excType(fc *funcContext) types.Type {
+	return eh.ExceptionType
+}
+
+func (itaniumLowering) enterFunc(ctx *Context, body Stmt) {}
+
+func (itaniumLowering) finishFunc(ctx *Context) {}
+
+func (l itaniumLowering) call(ctx *Context, h *handler, callee value.Value, args []value.Value) value.Value {
+	if h == nil {
+		return ctx.NewCall(callee, args...)
+	}
+	cont := ctx.newBlock("invoke.cont")
+	invoke := ctx.NewInvoke(callee, args, cont, l.landingPad(ctx, h))
+	ctx.moveTo(cont)
+	ctx.seal(cont)
+	return invoke
+}
+
+// landingPad returns the landing pad of h. It catches the exceptions of the
+// try regions around the scope of h in the function, and is a cleanup when
+// a scope around it has cleanups: the personality function only stops
+// unwinding at landing pads with a matching clause or a cleanup.
+func (itaniumLowering) landingPad(ctx *Context, h *handler) *ir.Block {
+	if h.lpad != nil {
+		return h.lpad
+	}
+	var catches []types.Type
+	cleanup := false
+	for c := h.ctx; c != nil; c = c.parent {
+		if c.try != nil {
+			for _, ca := range c.try.catches {
+				catches = append(catches, ca.Typ)
+			}
+		}
+		cleanup = cleanup || c.hasCleanups()
+	}
+	h.lpad = ctx.newBlock("lpad")
+	exc := ctx.fn.eh().NewLandingPad(h.lpad, catches...)
+	exc.Cleanup = cleanup || len(catches) == 0
+	ctx.fn.unsealed = append(ctx.fn.unsealed, h.lpad)
+	ctx.dispatchFrom(h, h.lpad, exc)
+	return h.lpad
+}
+
+func (itaniumLowering) throw(ctx *Context, v value.Value) {
+	rt := ctx.fn.eh()
+	ctx.call(rt.Throw, rt.ThrowArgs(ctx.Block, v)...)
+	ctx.NewUnreachable()
+}
+
+func (itaniumLowering) resume(ctx *Context, exc value.Value) {
+	ctx.NewResume(exc)
+}
+
+func (itaniumLowering) matches(b *ir.Block, exc value.Value, t types.Type) value.Value {
+	return eh.Plugin(b.Parent.Parent).Matches(b, exc, t)
+}
+
+func (itaniumLowering) beginCatch(b *ir.Block, exc value.Value, t types.Type) value.Value {
+	return eh.Plugin(b.Parent.Parent).NewBeginCatch(b, exc, t)
+}
+
+func (itaniumLowering) endCatch(b *ir.Block, exc value.Value) {
+	eh.Plugin(b.Parent.Parent).NewEndCatch(b)
+}
+
+// portableLowering is what EHSetjmp and EHErrorFlag share: the exception is
+// taken from the globals of eh.PortableRuntime when a handler is entered, and
+// put back when it leaves the function.
+type portableLowering struct{}
+
+func (portableLowering) excType(fc *funcContext) types.Type {
+	return eh.PortablePlugin(fc.module()).Exception
+}
+
+// landing returns the block that takes the exception for h.
+func (portableLowering) landing(ctx *Context, h *handler) *ir.Block {
+	if h.lpad != nil {
+		return h.lpad
+	}
+	h.lpad = ctx.newBlock("lpad")
+	exc := eh.PortablePlugin(ctx.fn.module()).NewTakeException(h.lpad)
+	ctx.fn.unsealed = append(ctx.fn.unsealed, h.lpad)
+	ctx.dispatchFrom(h, h.lpad, exc)
+	return h.lpad
+}
+
+func (portableLowering) matches(b *ir.Block, exc value.Value, t types.Type) value.Value {
+	return eh.PortablePlugin(b.Parent.Parent).NewMatches(b, exc, t)
+}
+
+func (portableLowering) beginCatch(b *ir.Block, exc value.Value, t types.Type) value.Value {
+	return eh.PortablePlugin(b.Parent.Parent).NewCatch(b, exc, t)
+}
+
+func (portableLowering) endCatch(b *ir.Block, exc value.Value) {
+	eh.PortablePlugin(b.Parent.Parent).NewEndCatch(b, exc)
+}
+
+// setjmpLowering pushes a frame at the start of a function with handlers and
+// pops it whenever the function is left, by a cleanup of the function scope.
+// Before each call, the number of the handler of its exceptions is stored in
+// a slot, which the dispatch on the return of setjmp switches on.
+type setjmpLowering struct {
+	portableLowering
+	frame, site value.Value
+	// dispatch is where setjmp returns to when unwinding
+	dispatch *ir.Block
+	// sites are the handlers by number, from 1
+	sites []*handler
+}
+
+func (l *setjmpLowering) enterFunc(ctx *Context, body Stmt) {
+	needed := false
+	inspect(body, func(s Stmt) {
+		switch s.(type) {
+		case *STry, *SDefer:
+			needed = true
+		case *SDefine:
+			// the exception releases the objects of the variables
+			needed = needed || ctx.fn.gc == GCRefCount
+		}
+	}, nil)
+	if !needed {
+		// exceptions only pass through
+		return
+	}
+	rt := eh.PortablePlugin(ctx.fn.module())
+	// longjmp restores the registers as they were at setjmp, the variables
+	// keep the values they were given after it in memory only, with volatile
+	// loads and stores that mem2reg and SROA leave alone
+	ctx.fn.varsInMemory = true
+	frame := ctx.newAlloca(rt.Frame, "eh.frame")
+	frame.Align = 16
+	l.frame = frame
+	l.site = ctx.newAlloca(TI32, "eh.site")
+	// the site is volatile like the variables
+	ctx.NewStore(CI32(0), l.site).Volatile = true
+	unwinding := ctx.NewICmp(enum.IPredNE, rt.NewPushFrame(ctx.Block, l.frame), CI32(0))
+	l.dispatch = ctx.newBlock("eh.dispatch")
+	bodyB := ctx.newBlock("eh.body")
+	ctx.NewCondBr(unwinding, l.dispatch, bodyB)
+	ctx.moveTo(bodyB)
+	ctx.seal(bodyB)
+	ctx.cleanups = append(ctx.cleanups, func(c *Context) {
+		rt.NewPopFrame(c.Block, l.frame)
+	})
+}
+
+func (l *setjmpLowering) finishFunc(ctx *Context) {
+	if l.dispatch == nil {
+		return
+	}
+	none := ctx.newBlock("eh.none")
+	none.NewUnreachable()
+	var cases []*ir.Case
+	for i, h := range l.sites {
+		cases = append(cases, ir.NewCase(CI32(int64(i+1)), l.landing(ctx, h)))
+	}
+	site := l.dispatch.NewLoad(TI32, l.site)
+	site.Volatile = true
+	l.dispatch.NewSwitch(site, none, cases...)
+}
+
+func (l *setjmpLowering) call(ctx *Context, h *handler, callee value.Value, args []value.Value) value.Value {
+	if h != nil {
+		site := 0
+		for i, s := range l.sites {
+			if s == h {
+				site = i + 1
+			}
+		}
+		if site == 0 {
+			l.sites = append(l.sites, h)
+			site = len(l.sites)
+		}
+		ctx.NewStore(CI32(int64(site)), l.site).Volatile = true
+	}
+	return ctx.NewCall(callee, args...)
+}
+
+func (l *setjmpLowering) throw(ctx *Context, v value.Value) {
+	rt := eh.PortablePlugin(ctx.fn.module())
+	rt.NewSetException(ctx.Block, v)
+	ctx.call(rt.Unwind)
+	ctx.NewUnreachable()
+}
+
+func (l *setjmpLowering) resume(ctx *Context, exc value.Value) {
+	rt := eh.PortablePlugin(ctx.fn.module())
+	rt.NewRestoreException(ctx.Block, exc)
+	// the frame of the function is popped already, the cleanup of the
+	// function scope ran
+	ctx.NewCall(rt.Unwind)
+	ctx.NewUnreachable()
+}
+
+// errorFlagLowering checks for an exception after each call, and returns a
+// zero value when it leaves the function, with the exception still set.
+type errorFlagLowering struct {
+	portableLowering
+	// propagate returns from the function for the calls without handler
+	propagate *ir.Block
+}
+
+func (errorFlagLowering) enterFunc(ctx *Context, body Stmt) {}
+
+func (errorFlagLowering) finishFunc(ctx *Context) {}
+
+func (l *errorFlagLowering) call(ctx *Context, h *handler, callee value.Value, args []value.Value) value.Value {
+	rt := eh.PortablePlugin(ctx.fn.module())
+	call := ctx.NewCall(callee, args...)
+	var target *ir.Block
+	if h != nil {
+		target = l.landing(ctx, h)
+	} else {
+		if l.propagate == nil {
+			l.propagate = ctx.newBlock("eh.propagate")
+			l.ret(l.propagate)
+		}
+		target = l.propagate
+	}
+	cont := ctx.newBlock("call.cont")
+	ctx.NewCondBr(rt.NewPending(ctx.Block), target, cont)
+	ctx.moveTo(cont)
+	ctx.seal(cont)
+	return call
+}
+
+func (l *errorFlagLowering) throw(ctx *Context, v value.Value) {
+	eh.PortablePlugin(ctx.fn.module()).NewSetException(ctx.Block, v)
+	if h := ctx.unwindHandler(); h != nil {
+		ctx.NewBr(l.landing(ctx, h))
+	} else {
+		l.ret(ctx.Block)
+	}
+}
+
+func (l *errorFlagLowering) resume(ctx *Context, exc value.Value) {
+	eh.PortablePlugin(ctx.fn.module()).NewRestoreException(ctx.Block, exc)
+	l.ret(ctx.Block)
+}
+
+// ret returns from the function of b with a zero value, which the caller does
+// not look at as the exception is set. main has no caller to check, it aborts
+// like std::terminate.
+func (errorFlagLowering) ret(b *ir.Block) {
+	f := b.Parent
+	if f.Name() == "main" {
+		b.NewCall(Declare(f.Parent, "abort", TVoid))
+		b.NewUnreachable()
+	} else if ret := f.Sig.RetType; ret.Equal(types.Void) {
+		b.NewRet(nil)
+	} else {
+		b.NewRet(constant.NewZeroInitializer(ret))
+	}
+}
@@ -0,0 +1,115 @@
+package controlflow
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/researchllvm/eh"
+	. "github.com/llir/researchllvm/helper"
+)
+
+func TestExceptionStrategies(t *testing.T) {
+	for _, s := range []EHStrategy{EHItanium, EHSetjmp, EHErrorFlag} {
+		m := ir.NewModule()
+		// each handler appends a digit to trace, the order they ran in
+		trace := m.NewGlobalDef("trace", CI32(0))
+		g := &EDeref{X: &EGlobal{G: trace}}
+		digit := func(d Expr) Stmt {
+			return &SStore{Target: g, Expr: &EAdd{Lhs: &EMul{Lhs: g, Rhs: &EI32{V: 10}}, Rhs: d}}
+		}
+		base := NewStruct(m, "error", Field{Name: "code", Typ: types.I32})
+		derived := NewStruct(m, "io_error",
+			Field{Name: "error", Typ: base.Typ},
+			Field{Name: "fd", Typ: types.I32},
+		)
+		if s == EHItanium {
+			eh.Plugin(m).Inherit(derived.Typ, base.Typ)
+		} else {
+			eh.PortablePlugin(m).Inherit(derived.Typ, base.Typ)
+		}
+
+		thrower := newThrower(t, m, WithSSA(), WithExceptions(s))
+		throwIO := m.NewFunc("throw_io", types.I32)
+		err := CompileFunc(throwIO, &SBlock{Stmts: []Stmt{
+			&SThrow{Expr: &EStructLit{Typ: derived, Fields: []FieldInit{
+				{Name: "error", Expr: &EStructLit{Typ: base, Fields: []FieldInit{{Name: "code", Expr: &EI32{V: 7}}}}},
+			}}},
+			&SRet{Val: &EI32{V: 0}},
+		}}, WithSSA(), WithExceptions(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		throw := func(x Expr) Stmt {
+			return &SExpr{Expr: &ECall{Callee: &EFunc{F: thrower}, Args: []Expr{x}}}
+		}
+		f := m.NewFunc("main", types.I32)
+		err = CompileFunc(f, &SBlock{Stmts: []Stmt{
+			&SBlock{Stmts: []Stmt{
+				&SDefer{Body: digit(&EI32{V: 1})},
+			}},
+			// the cleanup 2, the catch 3, then finally 4
+			&STry{
+				Body: &SBlock{Stmts: []Stmt{
+					&SDefer{Body: digit(&EI32{V: 2})},
+					throw(&EI32{V: 1}),
+					digit(&EI32{V: 9}),
+				}},
+				Catches: []Catch{{Typ: types.I32, Body: digit(&EI32{V: 3})}},
+				Finally: digit(&EI32{V: 4}),
+			},
+			// the catch sees the loop variable as it was at the throw, 5
+			// then 6
+			&SForLoop{
+				InitName: "i",
+				InitExpr: &EI32{V: 4},
+				Step:     &EAdd{Lhs: &EVariable{Name: "i"}, Rhs: &EI32{V: 1}},
+				Cond:     &ELessThan{Lhs: &EVariable{Name: "i"}, Rhs: &EI32{V: 6}},
+				Block: &STry{
+					Body:    throw(&EVariable{Name: "i"}),
+					Catches: []Catch{{Typ: types.I32, Body: digit(&EVariable{Name: "i"})}},
+				},
+			},
+			// the io_error caught as its base, 7
+			&STry{
+				Body: &SExpr{Expr: &ECall{Callee: &EFunc{F: throwIO}}},
+				Catches: []Catch{{Typ: base.Typ, Name: "e", Body: digit(
+					&EField{X: &EVariable{Name: "e"}, Name: "code"},
+				)}},
+			},
+			// exits with 0 when the trace is the same with each strategy
+			&SRet{Val: &ESub{Lhs: g, Rhs: &EI32{V: 1234567}}},
+		}}, WithSSA(), WithExceptions(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		PrettyPrint(m)
+
+		ExecuteIR(m)
+	}
+}
+
+func TestMixedStrategies(t *testing.T) {
+	m := ir.NewModule()
+	f := m.NewFunc("f", types.Void)
+	if err := CompileFunc(f, &SBlock{}, WithExceptions(EHSetjmp)); err != nil {
+		t.Fatal(err)
+	}
+	// h neither throws nor catches, it runs with either strategy
+	h := m.NewFunc("h", types.Void)
+	if err := CompileFunc(h, &SBlock{}); err != nil {
+		t.Fatal(err)
+	}
+	// calls of g would not see the exceptions of f, g throws with the
+	// default strategy
+	g := m.NewFunc("g", types.Void)
+	err := CompileFunc(g, &SThrow{Expr: &EI32{V: 1}})
+	if err == nil {
+		t.Fatal("expected an error for mixing exception strategies in a module")
+	}
+
+	fmt.Println(err)
+}
@@ -0,0 +1,67 @@
+package controlflow
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/types"
+)
+
+func TestUniqueNames(t *testing.T) {
+	f := ir.NewFunc("foo", types.Void)
+
+	err := CompileFunc(f, &SIf{
+		Cond: &EBool{V: true},
+		Then: &SIf{
+			Cond: &EBool{V: false},
+			Then: &SDoWhile{
+				Cond: &ELessThan{Lhs: &EVariable{Name: "x"}, Rhs: &EI32{V: 10}},
+				Block: &SDefine{
+					Name: "x",
+					Typ:  types.I32,
+					Expr: &EI32{V: 1},
+				},
+			},
+			Else: &SRet{Val: &EVoid{}},
+		},
+		Else: &SRet{Val: &EVoid{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Println(f.LLString())
+}
+
+// generated LLVM IR:
+//
+// ```
+// define void @foo() {
+// ; <label>:0
+// %x = alloca i32
+// br i1 true, label %if.then, label %if.else
+//
+// if.then:
+// br i1 false, label %do.while.body, label %if.else.1
+//
+// if.else:
+// ret void
+//
+// if.else.1:
+// ret void
+//
+// do.while.body:
+// %1 = bitcast i32* %x to i8*
+// call void @llvm.lifetime.start.p0i8(i64 -1, i8* %1)
+// store i32 1, i32* %x
+// %x.1 = load i32, i32* %x
+// %2 = icmp slt i32 %x.1, 10
+// %3 = bitcast i32* %x to i8*
+// call void @llvm.lifetime.end.p0i8(i64 -1, i8* %3)
+// br i1 %2, label %do.while.body, label %leave.if
+//
+// leave.if:
+// ret void
+// }
+// ```
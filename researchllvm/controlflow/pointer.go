@@ -0,0 +1,151 @@
+package controlflow
+
+import (
+	"fmt"
+
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+	. "github.com/llir/researchllvm/helper"
+)
+
+// compileAddr returns the address of the place e refers to.
+func (ctx *Context) compileAddr(e Expr) value.Value {
+	switch e := e.(type) {
+	case *EVariable:
+		v := ctx.lookupVariable(e.Name)
+		if v.addr() == nil {
+			panic(fmt.Sprintf("cannot take the address of `%s`, it has no stack slot", e.Name))
+		}
+		return v.addr()
+	case *EDeref:
+		return ctx.compileExpr(e.X)
+	case *EIndex:
+		if ptr, _ := ctx.compileIndex(e); ptr != nil {
+			return ptr
+		}
+	case *EField:
+		if ptr, _ := ctx.compileField(e); ptr != nil {
+			return ptr
+		}
+	case *EGlobal:
+		return e.G
+	}
+	panic("cannot take the address of the expression")
+}
+
+// compileIndex returns the address of the indexed element. For an array that
+// is a value rather than a place, it returns the element itself when the index
+// is constant.
+func (ctx *Context) compileIndex(e *EIndex) (ptr, val value.Value) {
+	if ctx.isPlace(e.X) {
+		base := ctx.compileAddr(e.X)
+		switch t := elemType(base).(type) {
+		case *types.ArrayType:
+			return ctx.NewGetElementPtr(t, base, CI64(0), ctx.index(e.Index)), nil
+		case *types.PointerType:
+			p := ctx.NewLoad(t, base)
+			return ctx.NewGetElementPtr(t.ElemType, p, ctx.index(e.Index)), nil
+		}
+		panic(fmt.Sprintf("cannot index %s", elemType(base)))
+	}
+	base := ctx.compileExpr(e.X)
+	switch t := base.Type().(type) {
+	case *types.PointerType:
+		return ctx.NewGetElementPtr(t.ElemType, base, ctx.index(e.Index)), nil
+	case *types.ArrayType:
+		idx := ctx.index(e.Index)
+		if c, ok := idx.(*constant.Int); ok {
+			return nil, ctx.NewExtractValue(base, c.X.Uint64())
+		}
+		// extractvalue takes constant indices only, the array is spilled
+		tmp := ctx.newAlloca(t, "")
+		ctx.NewStore(base, tmp)
+		return ctx.NewGetElementPtr(t, tmp, CI64(0), idx), nil
+	}
+	panic(fmt.Sprintf("cannot index %s", base.Type()))
+}
+
+// compileField returns the address of the field, or the field itself when the
+// struct is a value rather than a place.
+func (ctx *Context) compileField(e *EField) (ptr, val value.Value) {
+	if ctx.isPlace(e.X) {
+		base := ctx.compileAddr(e.X)
+		if t, ok := elemType(base).(*types.PointerType); ok {
+			// the place holds a pointer to the struct
+			base = ctx.NewLoad(t, base)
+		}
+		return ctx.structOf(elemType(base)).GEP(ctx.Block, base, e.Name), nil
+	}
+	base := ctx.compileExpr(e.X)
+	if t, ok := base.Type().(*types.PointerType); ok {
+		return ctx.structOf(t.ElemType).GEP(ctx.Block, base, e.Name), nil
+	}
+	return nil, ctx.structOf(base.Type()).Extract(ctx.Block, base, e.Name)
+}
+
+func (ctx *Context) structOf(t types.Type) *Struct {
+	s := StructOf(ctx.fn.module(), t)
+	if s == nil {
+		panic(fmt.Sprintf("%s has no named fields", t))
+	}
+	return s
+}
+
+// index compiles an array or pointer index as an i64, extended by its
+// signedness. A constant index stays constant.
+func (ctx *Context) index(e Expr) value.Value {
+	idx := ctx.compileExpr(e)
+	if c, ok := idx.(*constant.Int); ok {
+		return CI64(c.X.Int64())
+	}
+	return ctx.coerce(idx, TI64)
+}
+
+// isPlace reports whether e refers to a place in memory, whose address
+// compileAddr returns.
+func (ctx *Context) isPlace(e Expr) bool {
+	switch e := e.(type) {
+	case *EVariable:
+		return ctx.lookupVariable(e.Name).addr() != nil
+	case *EDeref, *EGlobal:
+		return true
+	case *EIndex:
+		return ctx.isPlace(e.X)
+	case *EField:
+		return ctx.isPlace(e.X)
+	}
+	return false
+}
+
+func elemType(ptr value.Value) types.Type {
+	t, ok := ptr.Type().(*types.PointerType)
+	if !ok {
+		panic(fmt.Sprintf("%s is not a pointer", ptr.Type()))
+	}
+	return t.ElemType
+}
+
+// inMemory reports whether the variable name of type typ lives in a stack
+// slot. In SSA form only arrays, variables whose address is taken do, see
+// addressTaken, variables captured by reference, and pointers that must be
+// roots of the shadow stack.
+func (fc *funcContext) inMemory(name string, typ types.Type) bool {
+	if fc.ssa == nil || fc.varsInMemory || fc.addressTaken[name] || fc.closures.byRef[name] {
+		return true
+	}
+	switch typ.(type) {
+	case *types.ArrayType:
+		return true
+	case *types.PointerType:
+		return fc.isRoot(typ)
+	}
+	return false
+}
+
+// isRoot reports whether the stack slot of a variable of type typ is a root
+// of the shadow stack, see helper.ShadowStackRoots.
+func (fc *funcContext) isRoot(typ types.Type) bool {
+	_, ok := typ.(*types.PointerType)
+	return ok && fc.gc == GCShadowStack
+}
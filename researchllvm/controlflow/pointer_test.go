@@ -0,0 +1,66 @@
+package controlflow
+
+import (
+	"testing"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/types"
+	. "github.com/llir/researchllvm/helper"
+)
+
+func TestPointer(t *testing.T) {
+	m := ir.NewModule()
+	arrTy := types.NewArray(5, types.I8)
+	arrayDef := m.NewGlobalDef("array_def", constant.NewArray(arrTy, CI8(1), CI8(2), CI8(3), CI8(4), CI8(5)))
+	f := m.NewFunc("main", types.I32)
+
+	err := CompileFunc(f, &SBlock{Stmts: []Stmt{
+		&SDefine{Name: "arr", Typ: types.NewArray(4, types.I32)},
+		&SDefine{Name: "i", Typ: types.I32, Expr: &EI32{V: 0}},
+		&SWhile{
+			Cond: &ELessThan{Lhs: &EVariable{Name: "i"}, Rhs: &EI32{V: 4}},
+			Block: &SBlock{Stmts: []Stmt{
+				// arr[i] = i * i
+				&SStore{
+					Target: &EIndex{X: &EVariable{Name: "arr"}, Index: &EVariable{Name: "i"}},
+					Expr:   &EMul{Lhs: &EVariable{Name: "i"}, Rhs: &EVariable{Name: "i"}},
+				},
+				&SAssign{Name: "i", Expr: &EAdd{Lhs: &EVariable{Name: "i"}, Rhs: &EI32{V: 1}}},
+			}},
+		},
+		// p = &arr[2]; *p = *p + 10
+		&SDefine{Name: "p", Typ: types.NewPointer(types.I32), Expr: &EAddrOf{X: &EIndex{X: &EVariable{Name: "arr"}, Index: &EI32{V: 2}}}},
+		&SStore{
+			Target: &EDeref{X: &EVariable{Name: "p"}},
+			Expr:   &EAdd{Lhs: &EDeref{X: &EVariable{Name: "p"}}, Rhs: &EI32{V: 10}},
+		},
+		// i keeps its stack slot in SSA form, its address is taken
+		&SDefine{Name: "q", Expr: &EAddrOf{X: &EVariable{Name: "i"}}},
+		&SStore{Target: &EDeref{X: &EVariable{Name: "q"}}, Expr: &EI32{V: 1}},
+		// array_def[4] = 0
+		&SStore{Target: &EIndex{X: &EGlobal{G: arrayDef}, Index: &EI32{V: 4}}, Expr: &EI8{V: 0}},
+		// arr[2] + p[-1] + i + array_def[0] + array_def[4] = 14 + 1 + 1 + 1 + 0
+		&SRet{Val: &EAdd{
+			Lhs: &EAdd{
+				Lhs: &EAdd{
+					Lhs: &EIndex{X: &EVariable{Name: "arr"}, Index: &EI32{V: 2}},
+					Rhs: &EIndex{X: &EVariable{Name: "p"}, Index: &EI32{V: -1}},
+				},
+				Rhs: &EVariable{Name: "i"},
+			},
+			Rhs: &EAdd{
+				Lhs: &EIndex{X: &EGlobal{G: arrayDef}, Index: &EI32{V: 0}},
+				Rhs: &EIndex{X: &EGlobal{G: arrayDef}, Index: &EI32{V: 4}},
+			},
+		}},
+	}}, WithSSA())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, isSlot := f.Blocks[0].Insts[1].(*ir.InstAlloca); !isSlot {
+		t.Errorf("expected stack slots for `arr` and `i`")
+	}
+
+	PrettyPrint(m)
+}
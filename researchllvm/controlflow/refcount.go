@@ -0,0 +1,108 @@
+package controlflow
+
+import (
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+	. "github.com/llir/researchllvm/helper"
+)
+
+// isManaged reports whether e is a reference with GCRefCount, when its value
+// is a pointer: a new object, a reference counted variable, or a pointer held
+// by an object. Other pointers, such as the address of a variable or a
+// global, are not counted.
+func (ctx *Context) isManaged(e Expr) bool {
+	if ctx.fn.gc != GCRefCount {
+		return false
+	}
+	switch e := e.(type) {
+	case *ENew:
+		return true
+	case *EVariable:
+		return ctx.lookupVariable(e.Name).managed
+	case *EField:
+		return ctx.inObject(e.X)
+	case *EIndex:
+		return ctx.inObject(e.X)
+	case *EDeref:
+		return ctx.isManaged(e.X)
+	}
+	return false
+}
+
+// inObject reports whether the place e is part of an object, or is a reference
+// to one.
+func (ctx *Context) inObject(e Expr) bool {
+	switch e := e.(type) {
+	case *EField:
+		return ctx.inObject(e.X)
+	case *EIndex:
+		return ctx.inObject(e.X)
+	}
+	return ctx.isManaged(e)
+}
+
+// destructor returns the destructor of objects of type t, nil without
+// reference counting or when t holds no references.
+func (fc *funcContext) destructor(t types.Type) *ir.Func {
+	if fc.gc != GCRefCount {
+		return nil
+	}
+	return RefCountPlugin(fc.module()).Destructor(t)
+}
+
+// compileNew allocates the object of e.
+func (ctx *Context) compileNew(e *ENew) value.Value {
+	opts := []HeapOption{Zeroed(), WithGC(ctx.fn.gc)}
+	if e.Len == nil {
+		if dtor := ctx.fn.destructor(e.Typ); dtor != nil {
+			opts = append(opts, WithDestructor(dtor))
+		}
+		return NewHeap(ctx.Block, e.Typ, opts...)
+	}
+	return NewHeapArray(ctx.Block, e.Typ, ctx.compileExpr(e.Len), opts...)
+}
+
+// compileOwned compiles e as a value that is stored in a variable or an object,
+// or returned. With GCRefCount, managed tells that the value is a reference of
+// its own: a new object is one already, other references are retained.
+func (ctx *Context) compileOwned(e Expr) (v value.Value, managed bool) {
+	if e, ok := e.(*ENew); ok {
+		return ctx.compileNew(e), ctx.fn.gc == GCRefCount
+	}
+	v = ctx.compileExpr(e)
+	if v == nil || !isPointer(v.Type()) || !ctx.isManaged(e) {
+		return v, false
+	}
+	Retain(ctx.Block, v)
+	return v, true
+}
+
+// compileCond compiles the condition or switch value e of a statement, the new
+// objects that e creates are released before the branch.
+func (ctx *Context) compileCond(e Expr) value.Value {
+	v := ctx.compileExpr(e)
+	ctx.releaseTemps()
+	return v
+}
+
+// own makes v a reference counted variable of the scope, which releases it
+// when the scope is left.
+func (ctx *Context) own(v *variable) {
+	v.managed = true
+	ctx.owned = append(ctx.owned, v)
+}
+
+// releaseTemps releases the new objects of the statement that no variable or
+// object took a reference to, such as an object that is only read from.
+func (ctx *Context) releaseTemps() {
+	for _, v := range ctx.fn.temps {
+		Release(ctx.Block, v)
+	}
+	ctx.fn.temps = nil
+}
+
+func isPointer(t types.Type) bool {
+	_, ok := t.(*types.PointerType)
+	return ok
+}
@@ -0,0 +1,59 @@
+package controlflow
+
+import (
+	"testing"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/types"
+	. "github.com/llir/researchllvm/helper"
+)
+
+func TestRefCount(t *testing.T) {
+	m := ir.NewModule()
+	// free only counts the freed objects, the runtime calls this one
+	freed := m.NewGlobalDef("freed", CI64(0))
+	free := m.NewFunc("free", types.Void, ir.NewParam("ptr", TPtr(TI8)))
+	freeB := free.NewBlock("")
+	freeB.NewStore(freeB.NewAdd(freeB.NewLoad(TI64, freed), CI64(1)), freed)
+	freeB.NewRet(nil)
+
+	node := NewStruct(m, "node",
+		Field{Name: "value", Typ: TI64},
+		Field{Name: "child", Typ: TPtr(TI64)},
+	)
+	f := m.NewFunc("main", types.I32)
+	a := &EVariable{Name: "a"}
+	err := CompileFunc(f, &SBlock{Stmts: []Stmt{
+		&SBlock{Stmts: []Stmt{
+			&SDefine{Name: "a", Expr: &ENew{Typ: node.Typ}},
+			// a new object is not retained, the node holds the only reference
+			&SStore{Target: &EField{X: a, Name: "child"}, Expr: &ENew{Typ: TI64}},
+			// retained, the first node has two references
+			&SDefine{Name: "b", Expr: a},
+			// releases one of them
+			&SAssign{Name: "a", Expr: &ENew{Typ: node.Typ}},
+			// a node that is only read from is freed after the statement
+			&SDefine{Name: "v", Typ: TI64, Expr: &EField{X: &ENew{Typ: node.Typ}, Name: "value"}},
+			// the address of a variable is not counted
+			&SDefine{Name: "p", Expr: &EAddrOf{X: &EVariable{Name: "v"}}},
+			// leaving the scope releases b, which frees the first node and
+			// its child, and a, which frees the second node
+		}},
+		&SIf{
+			Cond: &ELessThan{Lhs: &EDeref{X: &EGlobal{G: freed}}, Rhs: &EI64{V: 4}},
+			Then: &SRet{Val: &EI32{V: 1}},
+		},
+		&SIf{
+			Cond: &ELessThan{Lhs: &EI64{V: 4}, Rhs: &EDeref{X: &EGlobal{G: freed}}},
+			Then: &SRet{Val: &EI32{V: 1}},
+		},
+		&SRet{Val: &EI32{V: 0}},
+	}}, WithSSA(), WithCollector(GCRefCount))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	PrettyPrint(m)
+
+	ExecuteIR(m)
+}
@@ -0,0 +1,189 @@
+package controlflow
+
+import (
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/value"
+)
+
+// ssaBuilder constructs SSA form while the function is compiled, following
+// Braun et al., "Simple and Efficient Construction of Static Single Assignment
+// Form". A variable has a current value per block, reading it in a block
+// without one asks the predecessors, placing phis where they disagree.
+//
+// A block is sealed once all its predecessors are known. Reading in an
+// unsealed block, such as a loop header before its back edge exists, places
+// an incomplete phi that gets its operands when the block is sealed.
+type ssaBuilder struct {
+	f              *ir.Func
+	currentDef     map[*variable]map[*ir.Block]value.Value
+	sealed         map[*ir.Block]bool
+	incompletePhis map[*ir.Block][]incompletePhi
+	phiBlock       map[*ir.InstPhi]*ir.Block
+	fn             *funcContext
+}
+
+type incompletePhi struct {
+	v   *variable
+	phi *ir.InstPhi
+}
+
+func newSSABuilder(fc *funcContext) *ssaBuilder {
+	return &ssaBuilder{
+		f:              fc.entry.Parent,
+		currentDef:     make(map[*variable]map[*ir.Block]value.Value),
+		sealed:         make(map[*ir.Block]bool),
+		incompletePhis: make(map[*ir.Block][]incompletePhi),
+		phiBlock:       make(map[*ir.InstPhi]*ir.Block),
+		fn:             fc,
+	}
+}
+
+func (ssa *ssaBuilder) writeVariable(v *variable, b *ir.Block, val value.Value) {
+	defs, ok := ssa.currentDef[v]
+	if !ok {
+		defs = make(map[*ir.Block]value.Value)
+		ssa.currentDef[v] = defs
+	}
+	defs[b] = val
+}
+
+func (ssa *ssaBuilder) readVariable(v *variable, b *ir.Block) value.Value {
+	if val, ok := ssa.currentDef[v][b]; ok {
+		return val
+	}
+	return ssa.readVariableRecursive(v, b)
+}
+
+func (ssa *ssaBuilder) readVariableRecursive(v *variable, b *ir.Block) value.Value {
+	var val value.Value
+	if !ssa.sealed[b] {
+		phi := ssa.newPhi(v, b)
+		ssa.incompletePhis[b] = append(ssa.incompletePhis[b], incompletePhi{v: v, phi: phi})
+		val = phi
+	} else if preds := ssa.preds(b); len(preds) == 1 {
+		val = ssa.readVariable(v, preds[0])
+	} else {
+		// break cycles by writing the operandless phi before asking the
+		// predecessors
+		phi := ssa.newPhi(v, b)
+		ssa.writeVariable(v, b, phi)
+		val = ssa.addPhiOperands(v, phi)
+	}
+	ssa.writeVariable(v, b, val)
+	return val
+}
+
+func (ssa *ssaBuilder) newPhi(v *variable, b *ir.Block) *ir.InstPhi {
+	// ir.NewPhi takes the type from its first incoming value, which an
+	// incomplete phi does not have yet
+	phi := &ir.InstPhi{Typ: v.typ}
+	phi.SetName(ssa.fn.newName(v.name))
+	b.Insts = append([]ir.Instruction{phi}, b.Insts...)
+	ssa.phiBlock[phi] = b
+	return phi
+}
+
+func (ssa *ssaBuilder) addPhiOperands(v *variable, phi *ir.InstPhi) value.Value {
+	for _, pred := range ssa.preds(ssa.phiBlock[phi]) {
+		phi.Incs = append(phi.Incs, ir.NewIncoming(ssa.readVariable(v, pred), pred))
+	}
+	return ssa.tryRemoveTrivialPhi(phi)
+}
+
+// tryRemoveTrivialPhi replaces a phi whose operands are all the same value, or
+// the phi itself, by that value.
+func (ssa *ssaBuilder) tryRemoveTrivialPhi(phi *ir.InstPhi) value.Value {
+	var same value.Value
+	for _, inc := range phi.Incs {
+		if inc.X == same || inc.X == value.Value(phi) {
+			continue
+		}
+		if same != nil {
+			return phi
+		}
+		same = inc.X
+	}
+	if same == nil {
+		// the phi is unreachable or in the entry block
+		same = constant.NewUndef(phi.Typ)
+	}
+	b := ssa.phiBlock[phi]
+	for i, inst := range b.Insts {
+		if inst == ir.Instruction(phi) {
+			b.Insts = append(b.Insts[:i], b.Insts[i+1:]...)
+			break
+		}
+	}
+	delete(ssa.phiBlock, phi)
+	users := ssa.replaceUses(phi, same)
+	for _, user := range users {
+		if _, ok := ssa.phiBlock[user]; ok {
+			ssa.tryRemoveTrivialPhi(user)
+		}
+	}
+	return same
+}
+
+// replaceUses replaces every use of old in the function, and in the current
+// definitions of variables, by new. The phis that used old are returned.
+func (ssa *ssaBuilder) replaceUses(old, new value.Value) []*ir.InstPhi {
+	var phiUsers []*ir.InstPhi
+	for _, b := range ssa.f.Blocks {
+		for _, inst := range b.Insts {
+			used := false
+			for _, op := range operands(inst) {
+				if *op == old {
+					*op = new
+					used = true
+				}
+			}
+			if phi, ok := inst.(*ir.InstPhi); ok && used && value.Value(phi) != old {
+				phiUsers = append(phiUsers, phi)
+			}
+		}
+		if b.Term != nil {
+			for _, op := range operands(b.Term) {
+				if *op == old {
+					*op = new
+				}
+			}
+		}
+	}
+	for _, defs := range ssa.currentDef {
+		for b, val := range defs {
+			if val == old {
+				defs[b] = new
+			}
+		}
+	}
+	return phiUsers
+}
+
+func (ssa *ssaBuilder) sealBlock(b *ir.Block) {
+	if ssa.sealed[b] {
+		return
+	}
+	for _, inc := range ssa.incompletePhis[b] {
+		ssa.addPhiOperands(inc.v, inc.phi)
+	}
+	delete(ssa.incompletePhis, b)
+	ssa.sealed[b] = true
+}
+
+// preds returns the predecessors of b, by the terminators emitted so far.
+func (ssa *ssaBuilder) preds(b *ir.Block) []*ir.Block {
+	var preds []*ir.Block
+	for _, pred := range ssa.f.Blocks {
+		if pred.Term == nil {
+			continue
+		}
+		for _, succ := range pred.Term.Succs() {
+			if succ == b {
+				preds = append(preds, pred)
+				break
+			}
+		}
+	}
+	return preds
+}
@@ -0,0 +1,87 @@
+package controlflow
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/types"
+)
+
+func TestSSA(t *testing.T) {
+	f := ir.NewFunc("foo", types.I32)
+
+	err := CompileFunc(f, &SBlock{Stmts: []Stmt{
+		&SDefine{Name: "x", Typ: types.I32, Expr: &EI32{V: 0}},
+		&SDefine{Name: "i", Typ: types.I32, Expr: &EI32{V: 0}},
+		&SWhile{
+			Cond: &ELessThan{Lhs: &EVariable{Name: "i"}, Rhs: &EI32{V: 10}},
+			Block: &SBlock{Stmts: []Stmt{
+				&SIf{
+					Cond: &ELessThan{Lhs: &EVariable{Name: "i"}, Rhs: &EI32{V: 5}},
+					Then: &SAssign{Name: "x", Expr: &EAdd{Lhs: &EVariable{Name: "x"}, Rhs: &EI32{V: 1}}},
+					Else: &SAssign{Name: "x", Expr: &EAdd{Lhs: &EVariable{Name: "x"}, Rhs: &EI32{V: 2}}},
+				},
+				&SAssign{Name: "i", Expr: &EAdd{Lhs: &EVariable{Name: "i"}, Rhs: &EI32{V: 1}}},
+			}},
+		},
+		&SRet{Val: &EVariable{Name: "x"}},
+	}}, WithSSA())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Println(f.LLString())
+}
+
+func TestSSAForLoop(t *testing.T) {
+	f := ir.NewFunc("foo", types.Void)
+
+	err := CompileFunc(f, &SForLoop{
+		InitName: "x",
+		InitExpr: &EI32{V: 0},
+		Step:     &EAdd{Lhs: &EVariable{Name: "x"}, Rhs: &EI32{V: 1}},
+		Cond:     &ELessThan{Lhs: &EVariable{Name: "x"}, Rhs: &EI32{V: 10}},
+		Block:    &SDefine{Name: "foo", Typ: types.I32, Expr: &EVariable{Name: "x"}},
+	}, WithSSA())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Println(f.LLString())
+}
+
+// generated LLVM IR of TestSSA:
+//
+// ```
+// define i32 @foo() {
+// ; <label>:0
+// br label %while.loop.cond
+//
+// while.loop.cond:
+// %x = phi i32 [ 0, %0 ], [ %x.1, %leave.if ]
+// %i = phi i32 [ 0, %0 ], [ %5, %leave.if ]
+// %1 = icmp slt i32 %i, 10
+// br i1 %1, label %while.loop.body, label %leave.while.loop
+//
+// while.loop.body:
+// %2 = icmp slt i32 %i, 5
+// br i1 %2, label %if.then, label %if.else
+//
+// if.then:
+// %3 = add i32 %x, 1
+// br label %leave.if
+//
+// if.else:
+// %4 = add i32 %x, 2
+// br label %leave.if
+//
+// leave.if:
+// %x.1 = phi i32 [ %3, %if.then ], [ %4, %if.else ]
+// %5 = add i32 %i, 1
+// br label %while.loop.cond
+//
+// leave.while.loop:
+// ret i32 %x
+// }
+// ```
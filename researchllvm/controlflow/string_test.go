@@ -0,0 +1,68 @@
+package controlflow
+
+import (
+	"testing"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/types"
+	. "github.com/llir/researchllvm/helper"
+)
+
+func TestString(t *testing.T) {
+	m := ir.NewModule()
+	f := m.NewFunc("main", types.I32)
+
+	err := CompileFunc(f, &SBlock{Stmts: []Stmt{
+		&SDefine{Name: "s", Expr: &EConcat{Lhs: &EString{V: "Hello, "}, Rhs: &EString{V: "World!\n"}}},
+		&SPrint{Expr: &EVariable{Name: "s"}},
+		// "World", the literal "Hello, " is interned
+		&SPrint{Expr: &ESubstr{Str: &EVariable{Name: "s"}, Start: &EI32{V: 7}, Len: &EI32{V: 5}}},
+		&SPrint{Expr: &EString{V: "\n"}},
+		&SIf{
+			Cond: &ELessThan{Lhs: &EString{V: "Hello, "}, Rhs: &EVariable{Name: "s"}},
+			Then: &SRet{Val: &EI32{V: 0}},
+		},
+		&SRet{Val: &EI32{V: 1}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	PrettyPrint(m)
+
+	ExecuteIR(m)
+}
+
+// Output:
+//
+// Hello, World!
+// World
+
+func TestStringLinked(t *testing.T) {
+	// the runtime is defined in a module of its own
+	rt := ir.NewModule()
+	StringPlugin(rt)
+
+	m := ir.NewModule()
+	m.NewTypeDef("string", types.NewStruct(TPtr(TI8), TI64))
+	f := m.NewFunc("main", types.I32)
+	err := CompileFunc(f, &SBlock{Stmts: []Stmt{
+		&SPrint{Expr: &ESubstr{Str: &EConcat{Lhs: &EString{V: "Hello, "}, Rhs: &EString{V: "World!\n"}}, Start: &EI32{V: 7}, Len: &EI32{V: 7}}},
+		&SIf{
+			Cond: &ELessThan{Lhs: &EString{V: "Hello, "}, Rhs: &EString{V: "World!\n"}},
+			Then: &SRet{Val: &EI32{V: 0}},
+		},
+		&SRet{Val: &EI32{V: 1}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	PrettyPrint(m)
+
+	ExecuteIR(m, rt)
+}
+
+// Output:
+//
+// World!
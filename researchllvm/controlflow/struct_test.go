@@ -0,0 +1,37 @@
+package controlflow
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/types"
+	. "github.com/llir/researchllvm/helper"
+)
+
+func TestStructField(t *testing.T) {
+	m := ir.NewModule()
+	point := NewStruct(m, "point",
+		Field{Name: "x", Typ: types.I32},
+		Field{Name: "y", Typ: types.I32},
+	)
+	f := m.NewFunc("foo", types.I32)
+
+	err := CompileFunc(f, &SBlock{Stmts: []Stmt{
+		// y is zero
+		&SDefine{Name: "p", Expr: &EStructLit{Typ: point, Fields: []FieldInit{{Name: "x", Expr: &EI32{V: 3}}}}},
+		&SStore{Target: &EField{X: &EVariable{Name: "p"}, Name: "x"}, Expr: &EI32{V: 5}},
+		// through the pointer, q.y is (*q).y
+		&SDefine{Name: "q", Expr: &EAddrOf{X: &EVariable{Name: "p"}}},
+		&SStore{Target: &EField{X: &EVariable{Name: "q"}, Name: "y"}, Expr: &EI32{V: 6}},
+		&SRet{Val: &EAdd{
+			Lhs: &EField{X: &EVariable{Name: "p"}, Name: "x"},
+			Rhs: &EField{X: &EVariable{Name: "q"}, Name: "y"},
+		}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Println(m.String())
+}
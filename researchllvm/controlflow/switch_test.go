@@ -10,9 +10,8 @@ import (
 
 func TestSwitch(t *testing.T) {
 	f := ir.NewFunc("foo", types.Void)
-	ctx := NewContext(f.NewBlock(""))
 
-	ctx.compileStmt(&SSwitch{
+	err := CompileFunc(f, &SSwitch{
 		Target: &EBool{V: true},
 		CaseList: []struct {
 			EConstant
@@ -22,6 +21,9 @@ func TestSwitch(t *testing.T) {
 		},
 		DefaultCase: &SRet{Val: &EVoid{}},
 	})
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	fmt.Println(f.LLString())
 }
@@ -0,0 +1,297 @@
+package controlflow
+
+// inspect calls onStmt for stmt and its nested statements, and onExpr for
+// their expressions, a statement or expression before its parts. Either
+// function may be nil.
+func inspect(stmt Stmt, onStmt func(Stmt), onExpr func(Expr)) {
+	var expr func(e Expr)
+	expr = func(e Expr) {
+		if e == nil {
+			return
+		}
+		if onExpr != nil {
+			onExpr(e)
+		}
+		for _, child := range exprChildren(e) {
+			expr(child)
+		}
+	}
+	var walk func(s Stmt)
+	walk = func(s Stmt) {
+		if s == nil {
+			return
+		}
+		if onStmt != nil {
+			onStmt(s)
+		}
+		switch s := s.(type) {
+		case *SBlock:
+			for _, stmt := range s.Stmts {
+				walk(stmt)
+			}
+		case *SIf:
+			expr(s.Cond)
+			walk(s.Then)
+			walk(s.Else)
+		case *SSwitch:
+			expr(s.Target)
+			for _, ca := range s.CaseList {
+				walk(ca.Stmt)
+			}
+			walk(s.DefaultCase)
+		case *SDoWhile:
+			walk(s.Block)
+			expr(s.Cond)
+		case *SForLoop:
+			expr(s.InitExpr)
+			expr(s.Step)
+			walk(s.Block)
+			expr(s.Cond)
+		case *SWhile:
+			expr(s.Cond)
+			walk(s.Block)
+		case *SDefine:
+			expr(s.Expr)
+		case *SAssign:
+			expr(s.Expr)
+		case *SStore:
+			expr(s.Target)
+			expr(s.Expr)
+		case *SRet:
+			expr(s.Val)
+		case *SPrint:
+			expr(s.Expr)
+		case *SFree:
+			expr(s.Expr)
+		case *SExpr:
+			expr(s.Expr)
+		case *STry:
+			walk(s.Body)
+			for _, c := range s.Catches {
+				walk(c.Body)
+			}
+			walk(s.Finally)
+		case *SThrow:
+			expr(s.Expr)
+		case *SDefer:
+			walk(s.Body)
+		}
+	}
+	walk(stmt)
+}
+
+// exprChildren returns the operands of e. The body of a lambda is not part of
+// the expression, it is compiled as a function of its own.
+func exprChildren(e Expr) []Expr {
+	switch e := e.(type) {
+	case *EAdd:
+		return []Expr{e.Lhs, e.Rhs}
+	case *ESub:
+		return []Expr{e.Lhs, e.Rhs}
+	case *EMul:
+		return []Expr{e.Lhs, e.Rhs}
+	case *EDiv:
+		return []Expr{e.Lhs, e.Rhs}
+	case *ERem:
+		return []Expr{e.Lhs, e.Rhs}
+	case *EShl:
+		return []Expr{e.Lhs, e.Rhs}
+	case *EShr:
+		return []Expr{e.Lhs, e.Rhs}
+	case *ELessThan:
+		return []Expr{e.Lhs, e.Rhs}
+	case *EFCmp:
+		return []Expr{e.Lhs, e.Rhs}
+	case *EConcat:
+		return []Expr{e.Lhs, e.Rhs}
+	case *EStrCmp:
+		return []Expr{e.Lhs, e.Rhs}
+	case *ESubstr:
+		return []Expr{e.Str, e.Start, e.Len}
+	case *EConvert:
+		return []Expr{e.X}
+	case *ETrunc:
+		return []Expr{e.X}
+	case *EZExt:
+		return []Expr{e.X}
+	case *ESExt:
+		return []Expr{e.X}
+	case *EPtrToInt:
+		return []Expr{e.X}
+	case *EAddrOf:
+		return []Expr{e.X}
+	case *EDeref:
+		return []Expr{e.X}
+	case *EIndex:
+		return []Expr{e.X, e.Index}
+	case *EField:
+		return []Expr{e.X}
+	case *ENew:
+		return []Expr{e.Len}
+	case *ECall:
+		return append([]Expr{e.Callee}, e.Args...)
+	case *EStructLit:
+		children := make([]Expr, len(e.Fields))
+		for i, field := range e.Fields {
+			children[i] = field.Expr
+		}
+		return children
+	}
+	return nil
+}
+
+// addressTaken returns the names of the variables whose address is taken in
+// stmt, or that an element or field is stored into. Names are not resolved to
+// scopes, a name is taken for all variables called so.
+func addressTaken(stmt Stmt) map[string]bool {
+	names := map[string]bool{}
+	take := func(place Expr) {
+		if v, ok := placeRoot(place).(*EVariable); ok {
+			names[v.Name] = true
+		}
+	}
+	inspect(stmt, func(s Stmt) {
+		if store, ok := s.(*SStore); ok {
+			take(store.Target)
+		}
+	}, func(e Expr) {
+		if addr, ok := e.(*EAddrOf); ok {
+			take(addr.X)
+		}
+	})
+	return names
+}
+
+// placeRoot returns the expression a place is an element or field of, `a` for
+// `a[i].x`.
+func placeRoot(e Expr) Expr {
+	for {
+		switch place := e.(type) {
+		case *EIndex:
+			e = place.X
+		case *EField:
+			e = place.X
+		default:
+			return e
+		}
+	}
+}
+
+// freeVariables returns the variables that the body of a lambda with params
+// uses but does not define, in the order they are first used.
+func freeVariables(params []Param, body Stmt) []string {
+	var free []string
+	seen := map[string]bool{}
+	scopes := []map[string]bool{{}}
+	for _, param := range params {
+		scopes[0][param.Name] = true
+	}
+	define := func(name string) {
+		scopes[len(scopes)-1][name] = true
+	}
+	use := func(name string) {
+		for i := len(scopes) - 1; i >= 0; i-- {
+			if scopes[i][name] {
+				return
+			}
+		}
+		if !seen[name] {
+			seen[name] = true
+			free = append(free, name)
+		}
+	}
+	var expr func(e Expr)
+	expr = func(e Expr) {
+		switch e := e.(type) {
+		case *EVariable:
+			use(e.Name)
+		case *ELambda:
+			for _, name := range freeVariables(e.Params, e.Body) {
+				use(name)
+			}
+		default:
+			for _, child := range exprChildren(e) {
+				if child != nil {
+					expr(child)
+				}
+			}
+		}
+	}
+	var stmt func(s Stmt)
+	// scoped runs f in a new scope, like a child Context
+	scoped := func(f func()) {
+		scopes = append(scopes, map[string]bool{})
+		f()
+		scopes = scopes[:len(scopes)-1]
+	}
+	stmt = func(s Stmt) {
+		switch s := s.(type) {
+		case *SBlock:
+			scoped(func() {
+				for _, child := range s.Stmts {
+					stmt(child)
+				}
+			})
+		case *SIf:
+			expr(s.Cond)
+			scoped(func() { stmt(s.Then) })
+			scoped(func() { stmt(s.Else) })
+		case *SSwitch:
+			expr(s.Target)
+			for _, ca := range s.CaseList {
+				scoped(func() { stmt(ca.Stmt) })
+			}
+			scoped(func() { stmt(s.DefaultCase) })
+		case *SDoWhile:
+			scoped(func() {
+				stmt(s.Block)
+				expr(s.Cond)
+			})
+		case *SForLoop:
+			expr(s.InitExpr)
+			scoped(func() {
+				define(s.InitName)
+				expr(s.Step)
+				stmt(s.Block)
+				expr(s.Cond)
+			})
+		case *SWhile:
+			expr(s.Cond)
+			scoped(func() { stmt(s.Block) })
+		case *SDefine:
+			if s.Expr != nil {
+				expr(s.Expr)
+			}
+			define(s.Name)
+		case *SAssign:
+			use(s.Name)
+			expr(s.Expr)
+		case *SStore:
+			expr(s.Target)
+			expr(s.Expr)
+		case *SRet:
+			expr(s.Val)
+		case *SPrint:
+			expr(s.Expr)
+		case *SFree:
+			expr(s.Expr)
+		case *SExpr:
+			expr(s.Expr)
+		case *STry:
+			scoped(func() { stmt(s.Body) })
+			for _, c := range s.Catches {
+				scoped(func() {
+					define(c.Name)
+					stmt(c.Body)
+				})
+			}
+			scoped(func() { stmt(s.Finally) })
+		case *SThrow:
+			expr(s.Expr)
+		case *SDefer:
+			scoped(func() { stmt(s.Body) })
+		}
+	}
+	stmt(body)
+	return free
+}
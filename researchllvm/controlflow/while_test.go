@@ -10,9 +10,8 @@ import (
 
 func TestWhile(t *testing.T) {
 	f := ir.NewFunc("foo", types.Void)
-	ctx := NewContext(f.NewBlock(""))
 
-	ctx.compileStmt(&SWhile{
+	err := CompileFunc(f, &SWhile{
 		Cond: &EBool{V: true},
 		Block: &SDefine{
 			Name: "x",
@@ -20,8 +19,9 @@ func TestWhile(t *testing.T) {
 			Expr: &EI32{V: 0},
 		},
 	})
-
-	f.Blocks[len(f.Blocks)-1].NewRet(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	fmt.Println(f.LLString())
 }
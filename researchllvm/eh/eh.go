@@ -0,0 +1,135 @@
+// Package eh is the Itanium C++ exception handling runtime that LLVM lowers
+// invoke and landingpad to: the personality function of libstdc++, the type
+// info that exceptions are caught by, and builders to throw, catch and rethrow
+// exceptions. Programs using it link against the C++ runtime.
+package eh
+
+import (
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/enum"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+	. "github.com/llir/researchllvm/helper"
+)
+
+// Runtime is the C++ runtime of a module.
+type Runtime struct {
+	mod *ir.Module
+	// i32 @__gxx_personality_v0(...)
+	Personality *ir.Func
+	// i8* @__cxa_allocate_exception(i64 size)
+	AllocateException *ir.Func
+	// void @__cxa_throw(i8* exception, i8* tinfo, i8* dest)
+	Throw *ir.Func
+	// void @__cxa_rethrow()
+	Rethrow *ir.Func
+	// i8* @__cxa_begin_catch(i8* exception)
+	BeginCatch *ir.Func
+	// void @__cxa_end_catch()
+	EndCatch *ir.Func
+	// i32 @llvm.eh.typeid.for(i8* tinfo)
+	TypeIDFor *ir.Func
+}
+
+// Plugin declares the C++ runtime in mod. The declarations are shared, Plugin
+// can be called for each use.
+func Plugin(mod *ir.Module) *Runtime {
+	rt := &Runtime{mod: mod}
+	rt.Personality = Declare(mod, "__gxx_personality_v0", TI32)
+	rt.Personality.Sig.Variadic = true
+	rt.AllocateException = Declare(mod, "__cxa_allocate_exception", TPtr(TI8), ir.NewParam("size", TI64))
+	rt.Throw = Declare(mod, "__cxa_throw", TVoid,
+		ir.NewParam("exception", TPtr(TI8)),
+		ir.NewParam("tinfo", TPtr(TI8)),
+		ir.NewParam("dest", TPtr(TI8)),
+	)
+	rt.Rethrow = Declare(mod, "__cxa_rethrow", TVoid)
+	rt.BeginCatch = Declare(mod, "__cxa_begin_catch", TPtr(TI8), ir.NewParam("exception", TPtr(TI8)))
+	rt.EndCatch = Declare(mod, "__cxa_end_catch", TVoid)
+	rt.TypeIDFor = Declare(mod, "llvm.eh.typeid.for", TI32, ir.NewParam("tinfo", TPtr(TI8)))
+	return rt
+}
+
+// ExceptionType is the type of the value of a landingpad, the exception and
+// the selector telling which clause it matched.
+var ExceptionType = types.NewStruct(TPtr(TI8), TI32)
+
+// PersonalityFn returns the personality as the function attribute of f.
+func (rt *Runtime) PersonalityFn() constant.Constant {
+	return constant.NewBitCast(rt.Personality, TPtr(TI8))
+}
+
+// NewLandingPad starts b as a landing pad that catches exceptions of the types
+// catches, nil for a catch-all, and sets the personality of its function.
+func (rt *Runtime) NewLandingPad(b *ir.Block, catches ...types.Type) *ir.InstLandingPad {
+	b.Parent.Personality = rt.PersonalityFn()
+	var clauses []*ir.Clause
+	for _, t := range catches {
+		clauses = append(clauses, ir.NewClause(enum.ClauseTypeCatch, rt.clauseTypeInfo(t)))
+	}
+	return b.NewLandingPad(ExceptionType, clauses...)
+}
+
+func (rt *Runtime) clauseTypeInfo(t types.Type) constant.Constant {
+	if t == nil {
+		return constant.NewNull(TPtr(TI8))
+	}
+	return rt.TypeInfo(t)
+}
+
+// NewException copies v into a new exception object and returns it, ready for
+// Throw.
+func (rt *Runtime) NewException(b *ir.Block, v value.Value) value.Value {
+	var layout *DataLayout
+	exc := b.NewCall(rt.AllocateException, layout.Size(v.Type()))
+	b.NewStore(v, b.NewBitCast(exc, TPtr(v.Type())))
+	return exc
+}
+
+// ThrowArgs returns the arguments of Throw that throw v as an exception of its
+// type, for a call or an invoke.
+func (rt *Runtime) ThrowArgs(b *ir.Block, v value.Value) []value.Value {
+	return []value.Value{rt.NewException(b, v), rt.TypeInfo(v.Type()), constant.NewNull(TPtr(TI8))}
+}
+
+// NewThrow throws v as an exception of its type, b ends there.
+func (rt *Runtime) NewThrow(b *ir.Block, v value.Value) {
+	b.NewCall(rt.Throw, rt.ThrowArgs(b, v)...)
+	b.NewUnreachable()
+}
+
+// NewRethrow throws the exception being caught again, b ends there.
+func (rt *Runtime) NewRethrow(b *ir.Block) {
+	b.NewCall(rt.Rethrow)
+	b.NewUnreachable()
+}
+
+// Matches reports whether the exception exc of a landing pad matched the
+// catch clause of type t.
+func (rt *Runtime) Matches(b *ir.Block, exc value.Value, t types.Type) value.Value {
+	sel := b.NewExtractValue(exc, 1)
+	return b.NewICmp(enum.IPredEQ, sel, b.NewCall(rt.TypeIDFor, rt.TypeInfo(t)))
+}
+
+// NewBeginCatch starts to handle the exception exc of a landing pad, caught as
+// type t, and returns a t* to its value. The handler ends with NewEndCatch.
+func (rt *Runtime) NewBeginCatch(b *ir.Block, exc value.Value, t types.Type) value.Value {
+	payload := b.NewCall(rt.BeginCatch, b.NewExtractValue(exc, 0))
+	return b.NewBitCast(payload, TPtr(t))
+}
+
+// NewEndCatch ends the handler of the exception being caught, freeing it unless
+// it was rethrown.
+func (rt *Runtime) NewEndCatch(b *ir.Block) *ir.InstCall {
+	return b.NewCall(rt.EndCatch)
+}
+
+func (rt *Runtime) global(name string) *ir.Global {
+	for _, g := range rt.mod.Globals {
+		if g.Name() == name {
+			return g
+		}
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package eh
+
+import (
+	"fmt"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/enum"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+	. "github.com/llir/researchllvm/helper"
+)
+
+// PortableRuntime is an exception runtime in IR for targets that cannot link a
+// C++ unwinder. The exception being thrown is a payload on the heap and a type
+// descriptor, kept in globals until a handler takes it; a function finds out
+// by checking them after a call, or by a longjmp to a frame it pushed.
+type PortableRuntime struct {
+	mod *ir.Module
+	// %eh.type = type { %eh.type* }, the descriptor of an exception type and
+	// its base, see Inherit
+	Type *types.StructType
+	// %eh.frame = type { %eh.frame*, [64 x i64] }, the frame a function
+	// pushes for Unwind, the previous frame and a jmp_buf
+	Frame *types.StructType
+	// Exception is the type of an exception taken from the globals, its
+	// payload and type, `{ i8*, %eh.type* }`
+	Exception *types.StructType
+	// %eh.type* @eh.current, the type of the exception being thrown, null
+	// when there is none
+	Current *ir.Global
+	// i8* @eh.payload, the value of the exception being thrown
+	Payload *ir.Global
+	// %eh.frame* @eh.top, the last frame pushed
+	Top *ir.Global
+	// i1 @eh.matches(%eh.type* thrown, %eh.type* caught), whether caught is
+	// thrown or one of its bases
+	Matches *ir.Func
+	// void @eh.unwind(), longjmps to the top frame, aborts without
+	Unwind *ir.Func
+	// i32 @setjmp(i8* env), returns_twice
+	Setjmp *ir.Func
+}
+
+// PortablePlugin emits the portable exception runtime into mod, or returns the
+// one mod already has.
+func PortablePlugin(mod *ir.Module) *PortableRuntime {
+	rt := &PortableRuntime{mod: mod}
+	for _, def := range mod.TypeDefs {
+		if st, ok := def.(*types.StructType); ok {
+			switch def.Name() {
+			case "eh.type":
+				rt.Type = st
+			case "eh.frame":
+				rt.Frame = st
+			}
+		}
+	}
+	if rt.Type != nil {
+		rt.Exception = types.NewStruct(TPtr(TI8), TPtr(rt.Type))
+		rt.Current = rt.global("eh.current")
+		rt.Payload = rt.global("eh.payload")
+		rt.Top = rt.global("eh.top")
+		rt.Matches = Declare(mod, "eh.matches", types.I1,
+			ir.NewParam("thrown", TPtr(rt.Type)),
+			ir.NewParam("caught", TPtr(rt.Type)),
+		)
+		rt.Unwind = Declare(mod, "eh.unwind", TVoid)
+		rt.declareSetjmp()
+		return rt
+	}
+	typ := &types.StructType{}
+	typ.Fields = []types.Type{TPtr(typ)}
+	rt.Type = mod.NewTypeDef("eh.type", typ).(*types.StructType)
+	// the jmp_buf is 200 bytes on x86-64 and 312 on AArch64 with glibc
+	frame := &types.StructType{}
+	frame.Fields = []types.Type{TPtr(frame), types.NewArray(64, TI64)}
+	rt.Frame = mod.NewTypeDef("eh.frame", frame).(*types.StructType)
+	rt.Exception = types.NewStruct(TPtr(TI8), TPtr(rt.Type))
+
+	rt.Current = mod.NewGlobalDef("eh.current", constant.NewNull(TPtr(rt.Type)))
+	rt.Payload = mod.NewGlobalDef("eh.payload", constant.NewNull(TPtr(TI8)))
+	rt.Top = mod.NewGlobalDef("eh.top", constant.NewNull(TPtr(rt.Frame)))
+	rt.declareSetjmp()
+	rt.emitMatches()
+	rt.emitUnwind()
+	return rt
+}
+
+// TypeOf returns the descriptor of exceptions of type t, named like its type
+// info: `@eh.type.i` for an i32, `@eh.type.5error` for %error. Like type info,
+// it is linkonce_odr and points to the descriptor of the base of t, see
+// Inherit; other types have no descriptor.
+func (rt *PortableRuntime) TypeOf(t types.Type) constant.Constant {
+	var name string
+	if code, ok := fundamental[t]; ok {
+		name = "eh.type." + code
+	} else if st, ok := t.(*types.StructType); ok && st.Name() != "" {
+		name = "eh.type." + mangledName(st)
+	} else {
+		panic(fmt.Sprintf("no type descriptor for exceptions of type %s", t))
+	}
+	if g := rt.global(name); g != nil {
+		return g
+	}
+	return rt.newType(name, constant.NewNull(TPtr(rt.Type)))
+}
+
+// Inherit makes the struct type derived a class that inherits from base, like
+// Runtime.Inherit. The base is kept in the descriptor of derived, which
+// Inherit generates, so it must come before the descriptor of derived is used.
+func (rt *PortableRuntime) Inherit(derived, base *types.StructType) {
+	checkBase(derived, base)
+	name := "eh.type." + mangledName(derived)
+	if rt.global(name) != nil {
+		panic(fmt.Sprintf("the type descriptor of %s is generated already, without base", derived.Name()))
+	}
+	rt.newType(name, rt.TypeOf(base))
+}
+
+func (rt *PortableRuntime) newType(name string, base constant.Constant) *ir.Global {
+	g := rt.mod.NewGlobalDef(name, constant.NewStruct(rt.Type, base))
+	g.Linkage = enum.LinkageLinkOnceODR
+	g.Immutable = true
+	return g
+}
+
+// NewSetException copies v into a new payload and makes it the exception being
+// thrown, typed by the descriptor of its type. Control goes to the handler
+// afterwards, by Unwind or a branch.
+func (rt *PortableRuntime) NewSetException(b *ir.Block, v value.Value) {
+	payload := NewHeap(b, v.Type())
+	b.NewStore(v, payload)
+	rt.NewRestoreException(b, rt.exception(b, b.NewBitCast(payload, TPtr(TI8)), rt.TypeOf(v.Type())))
+}
+
+// NewTakeException returns the exception being thrown and clears it, so that
+// the calls of its handler do not see it.
+func (rt *PortableRuntime) NewTakeException(b *ir.Block) value.Value {
+	payload := b.NewLoad(TPtr(TI8), rt.Payload)
+	typ := b.NewLoad(TPtr(rt.Type), rt.Current)
+	b.NewStore(constant.NewNull(TPtr(rt.Type)), rt.Current)
+	return rt.exception(b, payload, typ)
+}
+
+// NewRestoreException makes the exception exc, as taken by NewTakeException,
+// the exception being thrown again.
+func (rt *PortableRuntime) NewRestoreException(b *ir.Block, exc value.Value) {
+	b.NewStore(b.NewExtractValue(exc, 0), rt.Payload)
+	b.NewStore(b.NewExtractValue(exc, 1), rt.Current)
+}
+
+// NewPending reports whether an exception is being thrown.
+func (rt *PortableRuntime) NewPending(b *ir.Block) value.Value {
+	typ := b.NewLoad(TPtr(rt.Type), rt.Current)
+	return b.NewICmp(enum.IPredNE, typ, constant.NewNull(TPtr(rt.Type)))
+}
+
+// NewMatches reports whether the exception exc is caught as type t.
+func (rt *PortableRuntime) NewMatches(b *ir.Block, exc value.Value, t types.Type) value.Value {
+	return b.NewCall(rt.Matches, b.NewExtractValue(exc, 1), rt.TypeOf(t))
+}
+
+// NewCatch returns a t* to the payload of the exception exc. The handler frees
+// it with NewEndCatch.
+func (rt *PortableRuntime) NewCatch(b *ir.Block, exc value.Value, t types.Type) value.Value {
+	return b.NewBitCast(b.NewExtractValue(exc, 0), TPtr(t))
+}
+
+// NewEndCatch frees the payload of the caught exception exc.
+func (rt *PortableRuntime) NewEndCatch(b *ir.Block, exc value.Value) *ir.InstCall {
+	return Free(b, b.NewExtractValue(exc, 0))
+}
+
+// NewPushFrame makes frame, a %eh.frame*, the top frame and returns the result
+// of setjmp on it: 0 now, and 1 when Unwind jumps back to it.
+func (rt *PortableRuntime) NewPushFrame(b *ir.Block, frame value.Value) value.Value {
+	b.NewStore(b.NewLoad(TPtr(rt.Frame), rt.Top), b.NewGetElementPtr(rt.Frame, frame, CI32(0), CI32(0)))
+	b.NewStore(frame, rt.Top)
+	return b.NewCall(rt.Setjmp, rt.jmpBuf(b, frame))
+}
+
+// NewPopFrame makes the frame before frame the top frame again.
+func (rt *PortableRuntime) NewPopFrame(b *ir.Block, frame value.Value) {
+	prev := b.NewLoad(TPtr(rt.Frame), b.NewGetElementPtr(rt.Frame, frame, CI32(0), CI32(0)))
+	b.NewStore(prev, rt.Top)
+}
+
+func (rt *PortableRuntime) exception(b *ir.Block, payload, typ value.Value) value.Value {
+	exc := b.NewInsertValue(constant.NewUndef(rt.Exception), payload, 0)
+	return b.NewInsertValue(exc, typ, 1)
+}
+
+func (rt *PortableRuntime) jmpBuf(b *ir.Block, frame value.Value) value.Value {
+	buf := b.NewGetElementPtr(rt.Frame, frame, CI32(0), CI32(1), CI32(0))
+	return b.NewBitCast(buf, TPtr(TI8))
+}
+
+// declareSetjmp declares setjmp, which returns twice.
+func (rt *PortableRuntime) declareSetjmp() {
+	rt.Setjmp = Declare(rt.mod, "setjmp", TI32, ir.NewParam("env", TPtr(TI8)))
+	for _, attr := range rt.Setjmp.FuncAttrs {
+		if attr == enum.FuncAttrReturnsTwice {
+			return
+		}
+	}
+	rt.Setjmp.FuncAttrs = append(rt.Setjmp.FuncAttrs, enum.FuncAttrReturnsTwice)
+}
+
+func (rt *PortableRuntime) emitMatches() {
+	thrown, caught := ir.NewParam("thrown", TPtr(rt.Type)), ir.NewParam("caught", TPtr(rt.Type))
+	rt.Matches = rt.mod.NewFunc("eh.matches", types.I1, thrown, caught)
+	rt.Matches.Linkage = enum.LinkageInternal
+	entry := rt.Matches.NewBlock("")
+	loop := rt.Matches.NewBlock("loop")
+	cmp := rt.Matches.NewBlock("cmp")
+	base := rt.Matches.NewBlock("base")
+	yes := rt.Matches.NewBlock("yes")
+	no := rt.Matches.NewBlock("no")
+	entry.NewBr(loop)
+
+	// walk up the bases of thrown
+	t := loop.NewPhi(ir.NewIncoming(thrown, entry))
+	loop.NewCondBr(loop.NewICmp(enum.IPredEQ, t, constant.NewNull(TPtr(rt.Type))), no, cmp)
+
+	cmp.NewCondBr(cmp.NewICmp(enum.IPredEQ, t, caught), yes, base)
+
+	next := base.NewLoad(TPtr(rt.Type), base.NewGetElementPtr(rt.Type, t, CI32(0), CI32(0)))
+	t.Incs = append(t.Incs, ir.NewIncoming(next, base))
+	base.NewBr(loop)
+
+	yes.NewRet(constant.True)
+	no.NewRet(constant.False)
+}
+
+func (rt *PortableRuntime) emitUnwind() {
+	rt.Unwind = rt.mod.NewFunc("eh.unwind", TVoid)
+	rt.Unwind.Linkage = enum.LinkageInternal
+	abort := Declare(rt.mod, "abort", TVoid)
+	longjmp := Declare(rt.mod, "longjmp", TVoid, ir.NewParam("env", TPtr(TI8)), ir.NewParam("val", TI32))
+	entry := rt.Unwind.NewBlock("")
+	uncaught := rt.Unwind.NewBlock("uncaught")
+	jump := rt.Unwind.NewBlock("jump")
+
+	top := entry.NewLoad(TPtr(rt.Frame), rt.Top)
+	entry.NewCondBr(entry.NewICmp(enum.IPredEQ, top, constant.NewNull(TPtr(rt.Frame))), uncaught, jump)
+
+	// like std::terminate
+	uncaught.NewCall(abort)
+	uncaught.NewUnreachable()
+
+	jump.NewCall(longjmp, rt.jmpBuf(jump, top), CI32(1))
+	jump.NewUnreachable()
+}
+
+func (rt *PortableRuntime) global(name string) *ir.Global {
+	for _, g := range rt.mod.Globals {
+		if g.Name() == name {
+			return g
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package eh
+
+import (
+	"fmt"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/enum"
+	"github.com/llir/llvm/ir/types"
+	. "github.com/llir/researchllvm/helper"
+)
+
+// Inherit makes the struct type derived a class that inherits from base, a
+// catch of base then catches exceptions of type derived. Like in C++, base is
+// the first field of derived, so that the exception is also a base.
+//
+// The inheritance is kept in the type info of derived, which Inherit
+// generates, so it must come before the type info of derived is used.
+func (rt *Runtime) Inherit(derived, base *types.StructType) {
+	checkBase(derived, base)
+	if rt.global("_ZTI"+mangledName(derived)) != nil {
+		panic(fmt.Sprintf("the type info of %s is generated already, without base", derived.Name()))
+	}
+	rt.classTypeInfo(derived, base)
+}
+
+func checkBase(derived, base *types.StructType) {
+	if len(derived.Fields) == 0 || derived.Fields[0] != base {
+		panic(fmt.Sprintf("%s does not start with its base %s", derived.Name(), base.Name()))
+	}
+}
+
+// fundamental are the codes of the fundamental types in mangled names, the
+// C++ runtime defines their type info.
+var fundamental = map[types.Type]string{
+	types.I1: "b",
+	TI8:      "a", TU8: "h",
+	TI16: "s", TU16: "t",
+	TI32: "i", TU32: "j",
+	TI64: "l", TU64: "m",
+	types.Float:  "f",
+	types.Double: "d",
+}
+
+// TypeInfo returns the type info of exceptions of type t as an i8*, `_ZTIi`
+// for an i32. A struct type defined in the module is a class named after it,
+// its type info is generated; other types have no type info.
+func (rt *Runtime) TypeInfo(t types.Type) constant.Constant {
+	if code, ok := fundamental[t]; ok {
+		name := "_ZTI" + code
+		return constant.NewBitCast(rt.external(name), TPtr(TI8))
+	}
+	if st, ok := t.(*types.StructType); ok && st.Name() != "" {
+		if g := rt.global("_ZTI" + mangledName(st)); g != nil {
+			return constant.NewBitCast(g, TPtr(TI8))
+		}
+		return constant.NewBitCast(rt.classTypeInfo(st, nil), TPtr(TI8))
+	}
+	panic(fmt.Sprintf("no type info for exceptions of type %s", t))
+}
+
+// classTypeInfo generates the type info of the class st: the name `_ZTS`, and
+// `_ZTI`, an `abi::__class_type_info`, or an `abi::__si_class_type_info` with
+// the type info of base for single inheritance. Both are linkonce_odr like in
+// C++, modules that throw and catch st share them.
+func (rt *Runtime) classTypeInfo(st, base *types.StructType) *ir.Global {
+	mangled := mangledName(st)
+	name := rt.mod.NewGlobalDef("_ZTS"+mangled, constant.NewCharArrayFromString(mangled+"\x00"))
+	name.Linkage = enum.LinkageLinkOnceODR
+	name.Immutable = true
+	fields := []constant.Constant{
+		nil,
+		constant.NewGetElementPtr(name.ContentType, name, CI64(0), CI64(0)),
+	}
+	vtable := "_ZTVN10__cxxabiv117__class_type_infoE"
+	if base != nil {
+		vtable = "_ZTVN10__cxxabiv120__si_class_type_infoE"
+		fields = append(fields, rt.TypeInfo(base))
+	}
+	vt := rt.external(vtable)
+	// the vtable pointer points past the offset to top and the type info of
+	// the vtable
+	fields[0] = constant.NewBitCast(constant.NewGetElementPtr(TPtr(TI8), vt, CI64(2)), TPtr(TI8))
+	var typs []types.Type
+	for range fields {
+		typs = append(typs, TPtr(TI8))
+	}
+	ti := rt.mod.NewGlobalDef("_ZTI"+mangled, constant.NewStruct(types.NewStruct(typs...), fields...))
+	ti.Linkage = enum.LinkageLinkOnceODR
+	ti.Immutable = true
+	return ti
+}
+
+// mangledName is the name of the class st in mangled names, `5error`.
+func mangledName(st *types.StructType) string {
+	return fmt.Sprintf("%d%s", len(st.Name()), st.Name())
+}
+
+// external returns the i8* global name that the C++ runtime defines.
+func (rt *Runtime) external(name string) *ir.Global {
+	g := rt.global(name)
+	if g == nil {
+		g = rt.mod.NewGlobal(name, TPtr(TI8))
+		g.Linkage = enum.LinkageExternal
+	}
+	return g
+}
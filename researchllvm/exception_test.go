@@ -5,98 +5,74 @@ import (
 
 	"github.com/llir/llvm/ir"
 	"github.com/llir/llvm/ir/constant"
-	"github.com/llir/llvm/ir/enum"
 	"github.com/llir/llvm/ir/types"
 	"github.com/llir/llvm/ir/value"
+	"github.com/llir/researchllvm/eh"
 	. "github.com/llir/researchllvm/helper"
 )
 
-type ModuleWithException struct {
-	*ir.Module
-	_ZTIi                    *ir.Global
-	__cxa_allocate_exception *ir.Func
-	__cxa_throw              *ir.Func
-	__cxa_begin_catch        *ir.Func
-	__cxa_end_catch          *ir.Func
-	__cxa_call_unexpected    *ir.Func
-	llvm_eh_typeid_for       *ir.Func
-}
-
-func NewModuleWithException() *ModuleWithException {
-	m := ir.NewModule()
-	mWithE := &ModuleWithException{
-		Module: m,
-		_ZTIi:  m.NewGlobal("_ZTIi", TPtr(TI8)),
-		__cxa_allocate_exception: m.NewFunc("__cxa_allocate_exception", TPtr(TI8),
-			ir.NewParam("", TI64),
-		),
-		__cxa_throw: m.NewFunc("__cxa_throw", TVoid,
-			ir.NewParam("exception_header", TPtr(TI8)),
-			ir.NewParam("", TPtr(TI8)),
-			ir.NewParam("", TPtr(TI8)),
-		),
-		__cxa_begin_catch:     m.NewFunc("__cxa_begin_catch", TPtr(TI8), ir.NewParam("", TPtr(TI8))),
-		__cxa_end_catch:       m.NewFunc("__cxa_end_catch", TVoid),
-		__cxa_call_unexpected: m.NewFunc("__cxa_call_unexpected", TVoid, ir.NewParam("", TPtr(TI8))),
-		llvm_eh_typeid_for:    m.NewFunc("llvm.eh.typeid.for", TI32, ir.NewParam("", TPtr(TI8))),
-	}
-	mWithE._ZTIi.Linkage = enum.LinkageExternal
-	return mWithE
-}
-
-func throwException(m *ModuleWithException, bb *ir.Block) {
-	exception_header := bb.NewCall(m.__cxa_allocate_exception, CI64(4))
-	bb.NewStore(CI32(1), bb.NewBitCast(exception_header, TPtr(TI32)))
-	bb.NewCall(m.__cxa_throw,
-		exception_header,
-		constant.NewBitCast(m._ZTIi, TPtr(TI8)),
-		constant.NewNull(TPtr(TI8)),
-	)
-}
-
 func TestException(t *testing.T) {
-	m := NewModuleWithException()
+	m := ir.NewModule()
+	rt := eh.Plugin(m)
 
 	exceptionThrower := m.NewFunc("I throw exception!", TI32)
 	bb := exceptionThrower.NewBlock("")
-	throwException(m, bb)
-	bb.NewRet(CI32(1))
+	rt.NewThrow(bb, CI32(42))
 
 	main := m.NewFunc("main", TI32)
-	main.Personality = constant.True
 	mainB := main.NewBlock("")
 	normalRetB := main.NewBlock("normalRet")
 	exceptionRetB := main.NewBlock("exceptionRet")
 	mainB.NewInvoke(exceptionThrower, []value.Value{}, normalRetB, exceptionRetB)
-	normalRetB.NewRet(CI32(0))
-	exc := exceptionRetB.NewLandingPad(types.NewStruct(TPtr(TI8), TI32),
-		ir.NewClause(enum.ClauseTypeCatch, constant.NewBitCast(m._ZTIi, TPtr(TI8))),
-		ir.NewClause(enum.ClauseTypeFilter,
-			constant.NewArray(types.NewArray(1, TPtr(TI8)), constant.NewBitCast(m._ZTIi, TPtr(TI8))),
-		),
-	)
-	exc.Cleanup = true
-	exc_ptr := exceptionRetB.NewExtractValue(exc, 0)
-	exc_sel := exceptionRetB.NewExtractValue(exc, 1)
-	tid_int := exceptionRetB.NewCall(m.llvm_eh_typeid_for, constant.NewBitCast(m._ZTIi, TPtr(TI8)))
-	tid_int.Tail = enum.TailTail
-	tst_int := exceptionRetB.NewICmp(enum.IPredEQ, exc_sel, tid_int)
+	normalRetB.NewRet(CI32(1))
+	// sets the personality of main
+	exc := rt.NewLandingPad(exceptionRetB, TI32)
 	catchintB := main.NewBlock("catchint")
-	cleanupB := main.NewBlock("cleanup")
-	cleanupB.NewResume(exc)
-	exceptionRetB.NewCondBr(tst_int, catchintB, cleanupB)
-	payload := catchintB.NewCall(m.__cxa_begin_catch, exc_ptr)
-	payload.Tail = enum.TailTail
-	payload_int := catchintB.NewBitCast(payload, TPtr(TI32))
-	retval := catchintB.NewLoad(TI32, payload_int)
-	end_catch := catchintB.NewCall(m.__cxa_end_catch)
-	end_catch.Tail = enum.TailTail
+	resumeB := main.NewBlock("resume")
+	resumeB.NewResume(exc)
+	exceptionRetB.NewCondBr(rt.Matches(exceptionRetB, exc, TI32), catchintB, resumeB)
+	payload := rt.NewBeginCatch(catchintB, exc, TI32)
+	retval := catchintB.NewLoad(TI32, payload)
+	rt.NewEndCatch(catchintB)
+	// exits with 0 when 42 was caught
+	catchintB.NewRet(catchintB.NewSub(retval, CI32(42)))
 
-	returnB := main.NewBlock("return")
-	catchintB.NewBr(returnB)
-	returnB.NewRet(retval)
+	PrettyPrint(m)
+
+	ExecuteIR(m)
+}
+
+func TestExceptionInheritance(t *testing.T) {
+	m := ir.NewModule()
+	rt := eh.Plugin(m)
+	base := NewStruct(m, "error", Field{Name: "code", Typ: TI32})
+	derived := NewStruct(m, "io_error",
+		Field{Name: "error", Typ: base.Typ},
+		Field{Name: "fd", Typ: TI32},
+	)
+	rt.Inherit(derived.Typ, base.Typ)
+
+	thrower := m.NewFunc("thrower", types.Void)
+	throwB := thrower.NewBlock("")
+	exc := PathOf(throwB, constant.NewZeroInitializer(derived.Typ)).Field("error").Field("code").Insert(CI32(42))
+	rt.NewThrow(throwB, derived.Insert(throwB, exc, CI32(3), "fd"))
+
+	main := m.NewFunc("main", TI32)
+	mainB := main.NewBlock("")
+	normalB := main.NewBlock("normal")
+	lpadB := main.NewBlock("lpad")
+	mainB.NewInvoke(thrower, nil, normalB, lpadB)
+	normalB.NewRet(CI32(1))
+	// an io_error is caught as its base
+	lp := rt.NewLandingPad(lpadB, base.Typ)
+	caught := lpadB.NewLoad(TI32, base.GEP(lpadB, rt.NewBeginCatch(lpadB, lp, base.Typ), "code"))
+	rt.NewEndCatch(lpadB)
+	// exits with 0 when the code is 42
+	lpadB.NewRet(lpadB.NewSub(caught, CI32(42)))
 
-	PrettyPrint(m.Module)
+	PrettyPrint(m)
 
-	ExecuteIR(m.Module)
+	ExecuteIR(m)
+	// linked against the C++ runtime
+	ExecuteNative(m)
 }
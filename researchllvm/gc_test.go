@@ -0,0 +1,45 @@
+package researchllvm
+
+import (
+	"testing"
+
+	"github.com/llir/irutil"
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/types"
+	. "github.com/llir/researchllvm/helper"
+)
+
+func TestBoehmGC(t *testing.T) {
+	if !HasLib("gc") {
+		t.Skip("libgc is not installed")
+	}
+	mod := ir.NewModule()
+
+	pair := NewStruct(mod, "pair",
+		Field{Name: "first", Typ: types.I32},
+		Field{Name: "second", Typ: types.NewPointer(types.I32)},
+	)
+	printf := PrintfPlugin(mod)
+	format := mod.NewGlobalDef("format", irutil.NewCString("%d %d\n"))
+
+	main := mod.NewFunc("main", types.I32)
+	b := main.NewBlock("")
+	b.NewCall(Declare(mod, "GC_init", types.Void))
+	p := NewHeap(b, pair.Typ, WithGC(GCBoehm))
+	second := NewHeap(b, types.I32, WithGC(GCBoehm))
+	b.NewStore(CI32(2), second)
+	PathOf(b, p).Field("first").Store(CI32(1))
+	PathOf(b, p).Field("second").Store(second)
+	first := PathOf(b, p).Field("first").Load()
+	b.NewCall(printf, PathOf(b, format).Index(CI32(0)).Addr(), first, b.NewLoad(types.I32, PathOf(b, p).Field("second").Load()))
+	b.NewRet(CI32(0))
+
+	PrettyPrint(mod)
+
+	// GC_malloc comes from libgc
+	ExecuteNative(mod, "gc")
+}
+
+// Output:
+//
+// 1 2
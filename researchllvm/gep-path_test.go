@@ -0,0 +1,58 @@
+package researchllvm
+
+import (
+	"testing"
+
+	"github.com/llir/irutil"
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/types"
+	. "github.com/llir/researchllvm/helper"
+)
+
+func TestGEPPath(t *testing.T) {
+	mod := ir.NewModule()
+
+	point := NewStruct(mod, "point",
+		Field{Name: "x", Typ: types.I32},
+		Field{Name: "y", Typ: types.I32},
+	)
+	line := NewStruct(mod, "line",
+		Field{Name: "from", Typ: point.Typ},
+		Field{Name: "to", Typ: point.Typ},
+	)
+	lines := mod.NewGlobalDef("lines", constant.NewZeroInitializer(types.NewArray(2, line.Typ)))
+
+	printf := PrintfPlugin(mod)
+	format := mod.NewGlobalDef("format", irutil.NewCString("%d %d\n"))
+
+	main := mod.NewFunc("main", types.I32)
+	mainB := main.NewBlock("")
+	// lines[1].to.y = 42, a single `getelementptr [2 x %line], [2 x %line]* @lines, i32 0, i32 1, i32 1, i32 1`
+	PathOf(mainB, lines).Index(CI32(1)).Field("to").Field("y").Store(CI32(42))
+	// the same element of the array held in a register, `extractvalue [2 x %line] %1, 1, 1, 1`
+	arr := mainB.NewLoad(types.NewArray(2, line.Typ), lines)
+	y := PathOf(mainB, arr).Index(CI32(1)).Field("to").Field(1).Extract()
+	// set lines[0].from.x in the register copy only
+	arr2 := PathOf(mainB, arr).Index(CI32(0)).Field("from").Field("x").Insert(CI32(7))
+	x := PathOf(mainB, arr2).Index(CI32(0)).Field("from").Field("x").Extract()
+	mainB.NewCall(printf, PathOf(mainB, format).Index(CI32(0)).Addr(), x, y)
+	mainB.NewRet(CI32(0))
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected a panic for an index out of bounds")
+			}
+		}()
+		PathOf(mainB, lines).Index(CI32(2))
+	}()
+
+	PrettyPrint(mod)
+
+	ExecuteIR(mod)
+}
+
+// Output:
+//
+// 7 42
@@ -0,0 +1,123 @@
+package helper
+
+import (
+	"fmt"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/enum"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+)
+
+// ClosureType returns the closure type of functions of signature sig,
+// `{ i8*, ret (i8*, params...)* }`: an environment, and a function taking it
+// as its first parameter before the parameters of sig. Closures of the same
+// signature have the same type whatever they capture, so that closures, and
+// plain functions wrapped by Thunk, can be stored in the same place.
+func ClosureType(sig *types.FuncType) *types.StructType {
+	params := append([]types.Type{TPtr(TI8)}, sig.Params...)
+	fn := types.NewFunc(sig.RetType, params...)
+	fn.Variadic = sig.Variadic
+	return types.NewStruct(TPtr(TI8), TPtr(fn))
+}
+
+// ClosureSig returns the signature of the closure type t, without environment
+// parameter, nil when t is not a closure type.
+func ClosureSig(t types.Type) *types.FuncType {
+	st, ok := t.(*types.StructType)
+	if !ok || len(st.Fields) != 2 || !st.Fields[0].Equal(TPtr(TI8)) {
+		return nil
+	}
+	fn := FuncSig(st.Fields[1])
+	if fn == nil || len(fn.Params) == 0 || !fn.Params[0].Equal(TPtr(TI8)) {
+		return nil
+	}
+	sig := types.NewFunc(fn.RetType, fn.Params[1:]...)
+	sig.Variadic = fn.Variadic
+	return sig
+}
+
+// FuncSig returns the signature of the function pointer type t, nil for other
+// types.
+func FuncSig(t types.Type) *types.FuncType {
+	if ptr, ok := t.(*types.PointerType); ok {
+		sig, _ := ptr.ElemType.(*types.FuncType)
+		return sig
+	}
+	return nil
+}
+
+// MakeClosure returns the closure of fn with the environment env, a pointer to
+// anything or nil for none. fn takes the environment as an i8* first
+// parameter. A closure of constants is a constant.
+func MakeClosure(b *ir.Block, env, fn value.Value) value.Value {
+	sig := FuncSig(fn.Type())
+	if sig == nil || len(sig.Params) == 0 || !sig.Params[0].Equal(TPtr(TI8)) {
+		panic(fmt.Sprintf("%s does not take an environment", fn.Type()))
+	}
+	typ := types.NewStruct(TPtr(TI8), fn.Type())
+	switch e := env.(type) {
+	case nil:
+		env = constant.NewNull(TPtr(TI8))
+	case constant.Constant:
+		if !e.Type().Equal(TPtr(TI8)) {
+			env = constant.NewBitCast(e, TPtr(TI8))
+		}
+	default:
+		env = toBytePtr(b, env)
+	}
+	envC, ok1 := env.(constant.Constant)
+	fnC, ok2 := fn.(constant.Constant)
+	if ok1 && ok2 {
+		return constant.NewStruct(typ, envC, fnC)
+	}
+	clo := b.NewInsertValue(constant.NewUndef(typ), env, 0)
+	return b.NewInsertValue(clo, fn, 1)
+}
+
+// CallClosure calls the closure clo with args, passing its environment first.
+func CallClosure(b *ir.Block, clo value.Value, args ...value.Value) *ir.InstCall {
+	if ClosureSig(clo.Type()) == nil {
+		panic(fmt.Sprintf("%s is not a closure", clo.Type()))
+	}
+	env := b.NewExtractValue(clo, 0)
+	fn := b.NewExtractValue(clo, 1)
+	return b.NewCall(fn, append([]value.Value{env}, args...)...)
+}
+
+// Thunk returns f as a closure with a null environment. The function
+// `<f>.thunk` it calls ignores the environment and calls f, it is generated
+// into the module of f once.
+func Thunk(f *ir.Func) constant.Constant {
+	mod := f.Parent
+	if mod == nil {
+		panic("the function must belong to a module")
+	}
+	name := f.Name() + ".thunk"
+	var thunk *ir.Func
+	for _, g := range mod.Funcs {
+		if g.Name() == name {
+			thunk = g
+		}
+	}
+	if thunk == nil {
+		params := []*ir.Param{ir.NewParam("env", TPtr(TI8))}
+		var args []value.Value
+		for _, p := range f.Params {
+			param := ir.NewParam(p.Name(), p.Typ)
+			params = append(params, param)
+			args = append(args, param)
+		}
+		thunk = mod.NewFunc(name, f.Sig.RetType, params...)
+		thunk.Linkage = enum.LinkageInternal
+		b := thunk.NewBlock("")
+		call := b.NewCall(f, args...)
+		if f.Sig.RetType.Equal(types.Void) {
+			b.NewRet(nil)
+		} else {
+			b.NewRet(call)
+		}
+	}
+	return constant.NewStruct(types.NewStruct(TPtr(TI8), thunk.Type()), constant.NewNull(TPtr(TI8)), thunk)
+}
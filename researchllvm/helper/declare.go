@@ -0,0 +1,17 @@
+package helper
+
+import (
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/types"
+)
+
+// Declare returns the function called name in mod, declaring it when mod does
+// not have it yet, so that helpers can share runtime functions and intrinsics.
+func Declare(mod *ir.Module, name string, retType types.Type, params ...*ir.Param) *ir.Func {
+	for _, f := range mod.Funcs {
+		if f.Name() == name {
+			return f
+		}
+	}
+	return mod.NewFunc(name, retType, params...)
+}
@@ -0,0 +1,146 @@
+package helper
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/llir/llvm/ir"
+)
+
+type dotConfig struct {
+	highlightLoops bool
+}
+
+// DotOption configures FuncToDot.
+type DotOption func(*dotConfig)
+
+// HighlightLoops draws back edges bold and red, and fills loop headers.
+func HighlightLoops() DotOption {
+	return func(c *dotConfig) { c.highlightLoops = true }
+}
+
+// FuncToDot renders the control flow graph of f in Graphviz DOT, nodes are the
+// basic blocks with their instructions. Render it with `dot -Tjpg`. It fails
+// when the local names of f cannot be numbered.
+func FuncToDot(f *ir.Func, opts ...DotOption) (string, error) {
+	config := &dotConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+	if err := f.AssignIDs(); err != nil {
+		return "", err
+	}
+	nodeID := map[*ir.Block]string{}
+	for i, b := range f.Blocks {
+		nodeID[b] = fmt.Sprintf("b%d", i)
+	}
+	backEdges, loopHeaders := findBackEdges(f)
+
+	buf := &strings.Builder{}
+	fmt.Fprintf(buf, "digraph %q {\n", f.Name())
+	buf.WriteString("  node [color=Black,fontname=Courier,shape=box]\n\n")
+	for _, b := range f.Blocks {
+		lines := []string{b.Ident() + ":"}
+		for _, inst := range b.Insts {
+			lines = append(lines, "  "+inst.LLString())
+		}
+		if b.Term != nil {
+			lines = append(lines, "  "+b.Term.LLString())
+		}
+		attrs := ""
+		if config.highlightLoops && loopHeaders[b] {
+			attrs = ",style=filled,fillcolor=lightyellow"
+		}
+		fmt.Fprintf(buf, "  %s [label=\"%s\\l\"%s]\n", nodeID[b], dotEscape(strings.Join(lines, "\n")), attrs)
+	}
+	buf.WriteString("\n")
+	for _, b := range f.Blocks {
+		for _, e := range edgesOf(b) {
+			var attrs []string
+			if e.label != "" {
+				attrs = append(attrs, fmt.Sprintf("label=\"%s\"", dotEscape(e.label)))
+			}
+			if config.highlightLoops && backEdges[[2]*ir.Block{b, e.to}] {
+				attrs = append(attrs, "color=red", "style=bold")
+			}
+			fmt.Fprintf(buf, "  %s -> %s", nodeID[b], nodeID[e.to])
+			if len(attrs) > 0 {
+				fmt.Fprintf(buf, " [%s]", strings.Join(attrs, ","))
+			}
+			buf.WriteString("\n")
+		}
+	}
+	buf.WriteString("}\n")
+	return buf.String(), nil
+}
+
+type dotEdge struct {
+	to    *ir.Block
+	label string
+}
+
+func edgesOf(b *ir.Block) []dotEdge {
+	switch term := b.Term.(type) {
+	case nil:
+		return nil
+	case *ir.TermCondBr:
+		return []dotEdge{
+			{to: term.TargetTrue.(*ir.Block), label: "true"},
+			{to: term.TargetFalse.(*ir.Block), label: "false"},
+		}
+	case *ir.TermSwitch:
+		edges := []dotEdge{}
+		for _, c := range term.Cases {
+			edges = append(edges, dotEdge{to: c.Target.(*ir.Block), label: c.X.Ident()})
+		}
+		return append(edges, dotEdge{to: term.TargetDefault.(*ir.Block), label: "default"})
+	case *ir.TermInvoke:
+		return []dotEdge{
+			{to: term.NormalRetTarget.(*ir.Block), label: "normal"},
+			{to: term.ExceptionRetTarget.(*ir.Block), label: "unwind"},
+		}
+	default:
+		edges := []dotEdge{}
+		for _, succ := range term.Succs() {
+			edges = append(edges, dotEdge{to: succ})
+		}
+		return edges
+	}
+}
+
+// findBackEdges finds the edges to a block that is still being visited by a
+// depth-first search from the entry block, the targets of them are loop
+// headers.
+func findBackEdges(f *ir.Func) (map[[2]*ir.Block]bool, map[*ir.Block]bool) {
+	backEdges := map[[2]*ir.Block]bool{}
+	loopHeaders := map[*ir.Block]bool{}
+	if len(f.Blocks) == 0 {
+		return backEdges, loopHeaders
+	}
+	visited := map[*ir.Block]bool{}
+	onStack := map[*ir.Block]bool{}
+	var visit func(b *ir.Block)
+	visit = func(b *ir.Block) {
+		visited[b] = true
+		onStack[b] = true
+		if b.Term != nil {
+			for _, succ := range b.Term.Succs() {
+				if onStack[succ] {
+					backEdges[[2]*ir.Block{b, succ}] = true
+					loopHeaders[succ] = true
+				} else if !visited[succ] {
+					visit(succ)
+				}
+			}
+		}
+		onStack[b] = false
+	}
+	visit(f.Blocks[0])
+	return backEdges, loopHeaders
+}
+
+func dotEscape(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return strings.ReplaceAll(s, "\n", `\l`)
+}
@@ -4,29 +4,109 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"strings"
 
 	"github.com/llir/llvm/ir"
 )
 
-func ExecuteIR(mod *ir.Module) {
+// The C++ runtime that programs throwing or catching exceptions run with. lli
+// loads the shared library CXXRuntimeLib, found by the dynamic loader, native
+// programs link with -l CXXRuntimeLink. Set them to libc++abi for a runtime
+// other than libstdc++.
+var (
+	CXXRuntimeLib  = "libstdc++.so.6"
+	CXXRuntimeLink = "stdc++"
+)
+
+// ExecuteIR runs mod with lli. The extra modules, such as GCRuntime, are
+// loaded next to it, and the C++ runtime when mod handles exceptions.
+func ExecuteIR(mod *ir.Module, extra ...*ir.Module) {
 	tmpIRName := "tmp.ll"
-	tmpIR, err := os.Create(tmpIRName)
+	writeIR(mod, tmpIRName)
+	args := []string{}
+	if usesCXXRuntime(mod) {
+		args = append(args, "-load="+CXXRuntimeLib)
+	}
+	for i, m := range extra {
+		name := fmt.Sprintf("tmp.%d.ll", i)
+		writeIR(m, name)
+		defer os.Remove(name)
+		args = append(args, "-extra-module="+name)
+	}
+	cmd := exec.Command("lli", append(args, tmpIRName)...)
+	run(cmd)
+	err := os.Remove(tmpIRName)
 	if err != nil {
 		panic(err)
 	}
+}
+
+// ExecuteNative compiles mod with llc, links it with the C compiler against
+// the libraries libs, `gc` for libgc, and the C++ runtime when mod handles
+// exceptions, and runs the program.
+func ExecuteNative(mod *ir.Module, libs ...string) {
+	if usesCXXRuntime(mod) {
+		libs = append(libs, CXXRuntimeLink)
+	}
+	tmpIRName, tmpObjName, tmpExeName := "tmp.ll", "tmp.o", "./tmp.out"
+	writeIR(mod, tmpIRName)
+	defer os.Remove(tmpIRName)
+	build(exec.Command("llc", "-filetype=obj", "-relocation-model=pic", tmpIRName, "-o", tmpObjName))
+	defer os.Remove(tmpObjName)
+	args := []string{tmpObjName, "-o", tmpExeName}
+	for _, lib := range libs {
+		args = append(args, "-l"+lib)
+	}
+	build(exec.Command("cc", args...))
+	defer os.Remove(tmpExeName)
+	run(exec.Command(tmpExeName))
+}
+
+// HasLib reports whether the C compiler can link programs against the library
+// lib, as ExecuteNative does. Tests skip programs needing a library that is
+// not installed, such as libgc.
+func HasLib(lib string) bool {
+	cmd := exec.Command("cc", "-x", "c", "-", "-o", os.DevNull, "-l"+lib)
+	cmd.Stdin = strings.NewReader("int main(void) { return 0; }\n")
+	return cmd.Run() == nil
+}
+
+// usesCXXRuntime reports whether mod refers to the C++ runtime, its
+// personality function or its `__cxa_` functions.
+func usesCXXRuntime(mod *ir.Module) bool {
+	for _, f := range mod.Funcs {
+		if f.Name() == "__gxx_personality_v0" || strings.HasPrefix(f.Name(), "__cxa_") {
+			return true
+		}
+	}
+	return false
+}
+
+func writeIR(mod *ir.Module, name string) {
+	tmpIR, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer tmpIR.Close()
 	_, err = mod.WriteTo(tmpIR)
 	if err != nil {
 		panic(err)
 	}
-	cmd := exec.Command("lli", "tmp.ll")
+}
+
+func build(cmd *exec.Cmd) {
 	stdoutStderr, err := cmd.CombinedOutput()
 	if err != nil {
-		fmt.Printf("Output:\n\n%s\n", stdoutStderr)
+		fmt.Printf("%s\n", stdoutStderr)
 		panic(err)
 	}
-	fmt.Printf("Output:\n\n%s\n", stdoutStderr)
-	err = os.Remove(tmpIRName)
+}
+
+func run(cmd *exec.Cmd) {
+	stdoutStderr, err := cmd.CombinedOutput()
 	if err != nil {
+		fmt.Printf("Output:\n\n%s\n", stdoutStderr)
 		panic(err)
 	}
+	fmt.Printf("Output:\n\n%s\n", stdoutStderr)
 }
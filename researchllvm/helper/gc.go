@@ -0,0 +1,287 @@
+package helper
+
+import (
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/enum"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+)
+
+// GCStrategy selects how heap helpers allocate memory.
+type GCStrategy int
+
+const (
+	// GCNone allocates with malloc, memory is released with Free.
+	GCNone GCStrategy = iota
+	// GCBoehm allocates with GC_malloc of the Boehm collector, the program
+	// must be linked against libgc, see ExecuteNative.
+	GCBoehm
+	// GCShadowStack allocates with gc.alloc of the collector of GCRuntime.
+	// Functions that hold heap pointers must register them as roots on the
+	// LLVM shadow stack, see ShadowStackRoots.
+	GCShadowStack
+	// GCRefCount allocates objects with a reference count, they are freed
+	// when the last reference is released, see RefCountPlugin. It needs no
+	// collector at all.
+	GCRefCount
+)
+
+// WithGC allocates memory managed by the strategy s. Memory that is not
+// allocated with malloc is always zeroed.
+func WithGC(s GCStrategy) HeapOption {
+	return func(hc *heapConfig) {
+		hc.gc = s
+	}
+}
+
+// allocator returns the allocation function of the strategy s in mod.
+func allocator(mod *ir.Module, s GCStrategy) *ir.Func {
+	switch s {
+	case GCBoehm:
+		return Declare(mod, "GC_malloc", TPtr(TI8), ir.NewParam("size", TI64))
+	case GCShadowStack:
+		return Declare(mod, "gc.alloc", TPtr(TI8), ir.NewParam("size", TI64))
+	}
+	return Declare(mod, "malloc", TPtr(TI8), ir.NewParam("size", TI64))
+}
+
+// ShadowStackRoots makes f use the shadow stack of GCShadowStack and
+// registers each stack slot of pointer type in its entry block as a root with
+// `llvm.gcroot`. LLVM initializes the roots to null on entry.
+//
+// Only stack slots are roots: a heap pointer that lives in a register alone,
+// such as a new object while the next one is allocated, is not.
+func ShadowStackRoots(f *ir.Func) {
+	if len(f.Blocks) == 0 {
+		return
+	}
+	f.GC = "shadow-stack"
+	gcroot := Declare(f.Parent, "llvm.gcroot", TVoid,
+		ir.NewParam("ptrloc", TPtr(TPtr(TI8))),
+		ir.NewParam("metadata", TPtr(TI8)),
+	)
+	entry := f.Blocks[0]
+	n := 0
+	var roots []ir.Instruction
+	for _, inst := range entry.Insts {
+		slot, ok := inst.(*ir.InstAlloca)
+		if !ok {
+			break
+		}
+		n++
+		if _, ok := slot.ElemType.(*types.PointerType); !ok {
+			continue
+		}
+		ptrloc := ir.NewBitCast(slot, TPtr(TPtr(TI8)))
+		roots = append(roots, ptrloc, ir.NewCall(gcroot, ptrloc, constant.NewNull(TPtr(TI8))))
+	}
+	entry.Insts = append(entry.Insts[:n:n], append(roots, entry.Insts[n:]...)...)
+}
+
+// gcThreshold is the number of bytes gc.alloc allocates between collections.
+const gcThreshold = 1 << 20
+
+// GCRuntime returns a module with the mark and sweep collector of
+// GCShadowStack, written in IR:
+//
+//	i8* @gc.alloc(i64 size)
+//	void @gc.collect()
+//
+// The roots are the slots that the shadow stack of LLVM chains from
+// @llvm_gc_root_chain. The collector is conservative, it scans every word of a
+// reachable object for pointers to the start of another object, and does not
+// move objects.
+//
+// The collector must be a module of its own: the shadow stack lowering of
+// LLVM gives @llvm_gc_root_chain a type of its own making, which does not
+// match the one of the collector inside one module. Load it next to the
+// program, for example with ExecuteIR(mod, GCRuntime()).
+func GCRuntime() *ir.Module {
+	rt := &gcRuntime{mod: ir.NewModule()}
+	mod := rt.mod
+	// struct FrameMap { i32 NumRoots; i32 NumMeta; i8* Meta[] }
+	rt.frameMap = mod.NewTypeDef("gc.frame_map", types.NewStruct(TI32, TI32)).(*types.StructType)
+	// struct StackEntry { StackEntry* Next; FrameMap* Map; i8* Roots[] }
+	stackEntry := &types.StructType{}
+	stackEntry.Fields = []types.Type{TPtr(stackEntry), TPtr(rt.frameMap)}
+	rt.stackEntry = mod.NewTypeDef("gc.stack_entry", stackEntry).(*types.StructType)
+	// the header in front of each object: next object, marked and size
+	header := &types.StructType{}
+	header.Fields = []types.Type{TPtr(header), TI64, TI64}
+	rt.header = mod.NewTypeDef("gc.header", header).(*types.StructType)
+
+	rt.rootChain = mod.NewGlobalDef("llvm_gc_root_chain", constant.NewNull(TPtr(rt.stackEntry)))
+	rt.objects = mod.NewGlobalDef("gc.objects", constant.NewNull(TPtr(rt.header)))
+	rt.objects.Linkage = enum.LinkageInternal
+	rt.allocated = mod.NewGlobalDef("gc.allocated", CI64(0))
+	rt.allocated.Linkage = enum.LinkageInternal
+
+	rt.emitMark()
+	rt.emitSweep()
+	rt.emitCollect()
+	rt.emitAlloc()
+	return mod
+}
+
+type gcRuntime struct {
+	mod                          *ir.Module
+	frameMap, stackEntry, header *types.StructType
+	rootChain, objects           *ir.Global
+	allocated                    *ir.Global
+	mark, sweep, collect         *ir.Func
+}
+
+func (rt *gcRuntime) payload(b *ir.Block, h value.Value) value.Value {
+	return b.NewBitCast(b.NewGetElementPtr(rt.header, h, CI32(1)), TPtr(TI8))
+}
+
+func (rt *gcRuntime) field(b *ir.Block, h value.Value, i int64) value.Value {
+	return b.NewGetElementPtr(rt.header, h, CI32(0), CI32(i))
+}
+
+// emitMark emits `void @gc.mark(i8* p)`, which marks the object p points to
+// and the objects reachable from it.
+func (rt *gcRuntime) emitMark() {
+	p := ir.NewParam("p", TPtr(TI8))
+	rt.mark = rt.mod.NewFunc("gc.mark", TVoid, p)
+	rt.mark.Linkage = enum.LinkageInternal
+	entry := rt.mark.NewBlock("")
+	find := rt.mark.NewBlock("find")
+	next := rt.mark.NewBlock("find.next")
+	found := rt.mark.NewBlock("found")
+	scan := rt.mark.NewBlock("scan")
+	done := rt.mark.NewBlock("done")
+
+	first := entry.NewLoad(TPtr(rt.header), rt.objects)
+	entry.NewCondBr(entry.NewICmp(enum.IPredEQ, p, constant.NewNull(TPtr(TI8))), done, find)
+
+	// look for the object that starts at p
+	h := find.NewPhi(ir.NewIncoming(first, entry))
+	find.NewCondBr(find.NewICmp(enum.IPredEQ, h, constant.NewNull(TPtr(rt.header))), done, next)
+	isObject := next.NewICmp(enum.IPredEQ, rt.payload(next, h), p)
+	nextH := next.NewLoad(TPtr(rt.header), rt.field(next, h, 0))
+	h.Incs = append(h.Incs, ir.NewIncoming(nextH, next))
+	next.NewCondBr(isObject, found, find)
+
+	marked := rt.field(found, h, 1)
+	wasMarked := found.NewICmp(enum.IPredNE, found.NewLoad(TI64, marked), CI64(0))
+	found.NewStore(CI64(1), marked)
+	words := found.NewUDiv(found.NewLoad(TI64, rt.field(found, h, 2)), CI64(8))
+	slots := found.NewBitCast(p, TPtr(TPtr(TI8)))
+	hasWords := found.NewICmp(enum.IPredNE, words, CI64(0))
+	found.NewCondBr(found.NewAnd(found.NewXor(wasMarked, constant.True), hasWords), scan, done)
+
+	// every word of the object might point to another object
+	i := scan.NewPhi(ir.NewIncoming(CI64(0), found))
+	scan.NewCall(rt.mark, scan.NewLoad(TPtr(TI8), scan.NewGetElementPtr(TPtr(TI8), slots, i)))
+	nextI := scan.NewAdd(i, CI64(1))
+	i.Incs = append(i.Incs, ir.NewIncoming(nextI, scan))
+	scan.NewCondBr(scan.NewICmp(enum.IPredULT, nextI, words), scan, done)
+
+	done.NewRet(nil)
+}
+
+// emitSweep emits `void @gc.sweep()`, which frees the objects that are not
+// marked and unmarks the others.
+func (rt *gcRuntime) emitSweep() {
+	rt.sweep = rt.mod.NewFunc("gc.sweep", TVoid)
+	rt.sweep.Linkage = enum.LinkageInternal
+	free := Declare(rt.mod, "free", TVoid, ir.NewParam("ptr", TPtr(TI8)))
+	entry := rt.sweep.NewBlock("")
+	loop := rt.sweep.NewBlock("loop")
+	visit := rt.sweep.NewBlock("visit")
+	keep := rt.sweep.NewBlock("keep")
+	drop := rt.sweep.NewBlock("drop")
+	done := rt.sweep.NewBlock("done")
+	entry.NewBr(loop)
+
+	// link is the place that points to h
+	link := loop.NewPhi(ir.NewIncoming(rt.objects, entry))
+	h := loop.NewLoad(TPtr(rt.header), link)
+	loop.NewCondBr(loop.NewICmp(enum.IPredEQ, h, constant.NewNull(TPtr(rt.header))), done, visit)
+
+	marked := rt.field(visit, h, 1)
+	isMarked := visit.NewICmp(enum.IPredNE, visit.NewLoad(TI64, marked), CI64(0))
+	nextLink := rt.field(visit, h, 0)
+	visit.NewCondBr(isMarked, keep, drop)
+
+	keep.NewStore(CI64(0), marked)
+	keep.NewBr(loop)
+
+	drop.NewStore(drop.NewLoad(TPtr(rt.header), nextLink), link)
+	drop.NewCall(free, drop.NewBitCast(h, TPtr(TI8)))
+	drop.NewBr(loop)
+
+	link.Incs = append(link.Incs, ir.NewIncoming(nextLink, keep), ir.NewIncoming(link, drop))
+	done.NewRet(nil)
+}
+
+// emitCollect emits `void @gc.collect()`, which marks from the roots of all
+// frames on the shadow stack and sweeps.
+func (rt *gcRuntime) emitCollect() {
+	rt.collect = rt.mod.NewFunc("gc.collect", TVoid)
+	entry := rt.collect.NewBlock("")
+	frame := rt.collect.NewBlock("frame")
+	roots := rt.collect.NewBlock("roots")
+	root := rt.collect.NewBlock("root")
+	nextFrame := rt.collect.NewBlock("frame.next")
+	done := rt.collect.NewBlock("done")
+	first := entry.NewLoad(TPtr(rt.stackEntry), rt.rootChain)
+	entry.NewBr(frame)
+
+	e := frame.NewPhi(ir.NewIncoming(first, entry))
+	frame.NewCondBr(frame.NewICmp(enum.IPredEQ, e, constant.NewNull(TPtr(rt.stackEntry))), done, roots)
+
+	frameMap := roots.NewLoad(TPtr(rt.frameMap), roots.NewGetElementPtr(rt.stackEntry, e, CI32(0), CI32(1)))
+	n := roots.NewLoad(TI32, roots.NewGetElementPtr(rt.frameMap, frameMap, CI32(0), CI32(0)))
+	// the roots follow the entry
+	slots := roots.NewBitCast(roots.NewGetElementPtr(rt.stackEntry, e, CI32(1)), TPtr(TPtr(TI8)))
+	roots.NewCondBr(roots.NewICmp(enum.IPredSGT, n, CI32(0)), root, nextFrame)
+
+	i := root.NewPhi(ir.NewIncoming(CI32(0), roots))
+	root.NewCall(rt.mark, root.NewLoad(TPtr(TI8), root.NewGetElementPtr(TPtr(TI8), slots, i)))
+	nextI := root.NewAdd(i, CI32(1))
+	i.Incs = append(i.Incs, ir.NewIncoming(nextI, root))
+	root.NewCondBr(root.NewICmp(enum.IPredSLT, nextI, n), root, nextFrame)
+
+	nextE := nextFrame.NewLoad(TPtr(rt.stackEntry), nextFrame.NewGetElementPtr(rt.stackEntry, e, CI32(0), CI32(0)))
+	e.Incs = append(e.Incs, ir.NewIncoming(nextE, nextFrame))
+	nextFrame.NewBr(frame)
+
+	done.NewCall(rt.sweep)
+	done.NewStore(CI64(0), rt.allocated)
+	done.NewRet(nil)
+}
+
+// emitAlloc emits `i8* @gc.alloc(i64 size)`, which collects once gcThreshold
+// bytes were allocated since the last collection.
+func (rt *gcRuntime) emitAlloc() {
+	size := ir.NewParam("size", TI64)
+	alloc := rt.mod.NewFunc("gc.alloc", TPtr(TI8), size)
+	malloc := Declare(rt.mod, "malloc", TPtr(TI8), ir.NewParam("size", TI64))
+	memset := Declare(rt.mod, "llvm.memset.p0i8.i64", TVoid,
+		ir.NewParam("dst", TPtr(TI8)),
+		ir.NewParam("val", TI8),
+		ir.NewParam("len", TI64),
+		ir.NewParam("isvolatile", types.I1),
+	)
+	entry := alloc.NewBlock("")
+	collect := alloc.NewBlock("collect")
+	allocate := alloc.NewBlock("allocate")
+
+	allocated := entry.NewAdd(entry.NewLoad(TI64, rt.allocated), size)
+	entry.NewCondBr(entry.NewICmp(enum.IPredUGT, allocated, CI64(gcThreshold)), collect, allocate)
+	collect.NewCall(rt.collect)
+	collect.NewBr(allocate)
+
+	total := allocate.NewAdd((*DataLayout)(nil).Size(rt.header), size)
+	raw := allocate.NewCall(malloc, total)
+	allocate.NewCall(memset, raw, CI8(0), total, constant.False)
+	h := allocate.NewBitCast(raw, TPtr(rt.header))
+	allocate.NewStore(allocate.NewLoad(TPtr(rt.header), rt.objects), rt.field(allocate, h, 0))
+	allocate.NewStore(size, rt.field(allocate, h, 2))
+	allocate.NewStore(h, rt.objects)
+	allocate.NewStore(allocate.NewAdd(allocate.NewLoad(TI64, rt.allocated), size), rt.allocated)
+	allocate.NewRet(rt.payload(allocate, h))
+}
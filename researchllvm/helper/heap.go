@@ -0,0 +1,123 @@
+package helper
+
+import (
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+)
+
+// HeapOption configures how NewHeap and NewHeapArray allocate.
+type HeapOption func(hc *heapConfig)
+
+type heapConfig struct {
+	zeroed bool
+	gc     GCStrategy
+	dtor   *ir.Func
+}
+
+// Zeroed fills the allocated memory with zeros with `llvm.memset`.
+func Zeroed() HeapOption {
+	return func(hc *heapConfig) {
+		hc.zeroed = true
+	}
+}
+
+// NewHeap allocates a t on the heap with malloc, or the collector of WithGC,
+// and returns a t*.
+//
+// The size comes from the data layout of the module, or is the
+// target-independent `getelementptr null, 1` constant when the module has
+// none, see DataLayout.Size.
+func NewHeap(b *ir.Block, t types.Type, opts ...HeapOption) value.Value {
+	return allocHeap(b, t, moduleLayout(b).Size(t), opts)
+}
+
+// NewHeapArray allocates n elements of type t on the heap and returns a t* to
+// the first one.
+func NewHeapArray(b *ir.Block, t types.Type, n value.Value, opts ...HeapOption) value.Value {
+	size := moduleLayout(b).Size(t)
+	if c, ok := n.(*constant.Int); ok {
+		if elem, ok := size.(*constant.Int); ok {
+			return allocHeap(b, t, CI64(c.X.Int64()*elem.X.Int64()), opts)
+		}
+	}
+	return allocHeap(b, t, b.NewMul(toI64(b, n), size), opts)
+}
+
+// Free frees the memory ptr points to, allocated by NewHeap or NewHeapArray
+// without collector.
+func Free(b *ir.Block, ptr value.Value) *ir.InstCall {
+	free := Declare(moduleOf(b), "free", TVoid, ir.NewParam("ptr", TPtr(TI8)))
+	return b.NewCall(free, toBytePtr(b, ptr))
+}
+
+func allocHeap(b *ir.Block, t types.Type, size value.Value, opts []HeapOption) value.Value {
+	hc := &heapConfig{}
+	for _, opt := range opts {
+		opt(hc)
+	}
+	mod := moduleOf(b)
+	var raw *ir.InstCall
+	if hc.gc == GCRefCount {
+		rt := RefCountPlugin(mod)
+		var dtor value.Value = constant.NewNull(rt.DtorType)
+		if hc.dtor != nil {
+			dtor = hc.dtor
+		}
+		raw = b.NewCall(rt.Alloc, size, dtor)
+	} else {
+		raw = b.NewCall(allocator(mod, hc.gc), size)
+	}
+	if hc.zeroed && hc.gc == GCNone {
+		memset := Declare(mod, "llvm.memset.p0i8.i64", TVoid,
+			ir.NewParam("dst", TPtr(TI8)),
+			ir.NewParam("val", TI8),
+			ir.NewParam("len", TI64),
+			ir.NewParam("isvolatile", types.I1),
+		)
+		b.NewCall(memset, raw, CI8(0), size, constant.False)
+	}
+	if t.Equal(TI8) {
+		return raw
+	}
+	return b.NewBitCast(raw, TPtr(t))
+}
+
+func moduleOf(b *ir.Block) *ir.Module {
+	if b.Parent == nil || b.Parent.Parent == nil {
+		panic("the block must belong to a function of a module")
+	}
+	return b.Parent.Parent
+}
+
+// moduleLayout returns the data layout of the module of b, nil when it has
+// none.
+func moduleLayout(b *ir.Block) *DataLayout {
+	if layout := moduleOf(b).DataLayout; layout != "" {
+		return NewDataLayout(layout)
+	}
+	return nil
+}
+
+func toI64(b *ir.Block, n value.Value) value.Value {
+	t, ok := n.Type().(*types.IntType)
+	switch {
+	case !ok:
+		panic("the number of elements must be an integer")
+	case t.BitSize < 64 && IsUnsigned(t):
+		return b.NewZExt(n, TI64)
+	case t.BitSize < 64:
+		return b.NewSExt(n, TI64)
+	case t.BitSize > 64:
+		return b.NewTrunc(n, TI64)
+	}
+	return n
+}
+
+func toBytePtr(b *ir.Block, ptr value.Value) value.Value {
+	if ptr.Type().Equal(TPtr(TI8)) {
+		return ptr
+	}
+	return b.NewBitCast(ptr, TPtr(TI8))
+}
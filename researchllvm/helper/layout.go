@@ -0,0 +1,260 @@
+package helper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/types"
+)
+
+// DataLayout computes sizes, ABI alignments and field offsets of types the
+// way LLVM does for a target data layout string, see
+// https://llvm.org/docs/LangRef.html#data-layout. Sizes are allocation sizes
+// in bytes, the distance between consecutive elements of an array.
+type DataLayout struct {
+	layout    string
+	BigEndian bool
+	// pointers of address space 0
+	PointerSize, PointerAlign uint64
+	// ABI alignments by bit size
+	intAlign, floatAlign, vectorAlign map[uint64]uint64
+	aggregateAlign                    uint64
+}
+
+// Data layouts of common targets.
+var (
+	X86_64 = NewDataLayout("e-m:e-p270:32:32-p271:32:32-p272:64:64-i64:64-f80:128-n8:16:32:64-S128")
+	I386   = NewDataLayout("e-m:e-p:32:32-p270:32:32-p271:32:32-p272:64:64-f64:32:64-f80:32-n8:16:32-S128")
+)
+
+// NewDataLayout parses the data layout string layout. Specifications it does
+// not set keep the defaults of LLVM.
+func NewDataLayout(layout string) *DataLayout {
+	dl := &DataLayout{
+		layout:         layout,
+		PointerSize:    8,
+		PointerAlign:   8,
+		intAlign:       map[uint64]uint64{1: 1, 8: 1, 16: 2, 32: 4, 64: 4},
+		floatAlign:     map[uint64]uint64{16: 2, 32: 4, 64: 8, 128: 16},
+		vectorAlign:    map[uint64]uint64{64: 8, 128: 16},
+		aggregateAlign: 1,
+	}
+	if layout == "" {
+		return dl
+	}
+	for _, spec := range strings.Split(layout, "-") {
+		if spec == "" {
+			panic(fmt.Sprintf("malformed data layout `%s`", layout))
+		}
+		fields := strings.Split(spec, ":")
+		switch kind := spec[0]; {
+		case spec == "e":
+			dl.BigEndian = false
+		case spec == "E":
+			dl.BigEndian = true
+		case kind == 'p':
+			if addrSpace := fields[0][1:]; addrSpace != "" && addrSpace != "0" {
+				continue
+			}
+			dl.PointerSize = bits(spec, fields, 1)
+			dl.PointerAlign = bits(spec, fields, 2)
+		case kind == 'i' || kind == 'f' || kind == 'v':
+			size, err := strconv.ParseUint(fields[0][1:], 10, 64)
+			if err != nil {
+				panic(fmt.Sprintf("malformed data layout specification `%s`", spec))
+			}
+			table := map[byte]map[uint64]uint64{'i': dl.intAlign, 'f': dl.floatAlign, 'v': dl.vectorAlign}[kind]
+			table[size] = bits(spec, fields, 1)
+		case kind == 'a':
+			// LLVM's own layouts say `a:0:64`, an ABI alignment of 0 is 1
+			dl.aggregateAlign = bits(spec, fields, 1)
+			if dl.aggregateAlign == 0 {
+				dl.aggregateAlign = 1
+			}
+		}
+		// mangling, native integer widths, stack alignment and so on do not
+		// change the layout of types
+	}
+	return dl
+}
+
+// bits returns the field i of a specification, a number of bits, in bytes.
+func bits(spec string, fields []string, i int) uint64 {
+	if i >= len(fields) {
+		panic(fmt.Sprintf("malformed data layout specification `%s`", spec))
+	}
+	n, err := strconv.ParseUint(fields[i], 10, 64)
+	if err != nil || n%8 != 0 {
+		panic(fmt.Sprintf("malformed data layout specification `%s`", spec))
+	}
+	return n / 8
+}
+
+// String is the data layout string, for ir.Module.DataLayout.
+func (dl *DataLayout) String() string {
+	return dl.layout
+}
+
+// SizeOf returns the allocation size of t in bytes, padded to its alignment.
+func (dl *DataLayout) SizeOf(t types.Type) uint64 {
+	return alignTo(dl.storeSize(t), dl.AlignOf(t))
+}
+
+// storeSize is the number of bytes a store of t may write, without the
+// padding to its alignment.
+func (dl *DataLayout) storeSize(t types.Type) uint64 {
+	switch t := t.(type) {
+	case *types.IntType:
+		return (t.BitSize + 7) / 8
+	case *types.FloatType:
+		return (floatBits(t) + 7) / 8
+	case *types.PointerType:
+		return dl.PointerSize
+	case *types.ArrayType:
+		return t.Len * dl.SizeOf(t.ElemType)
+	case *types.VectorType:
+		return (t.Len*dl.elemBits(t.ElemType) + 7) / 8
+	case *types.StructType:
+		if t.Opaque {
+			break
+		}
+		if len(t.Fields) == 0 {
+			return 0
+		}
+		last := len(t.Fields) - 1
+		return dl.OffsetOf(t, last) + dl.SizeOf(t.Fields[last])
+	}
+	panic(fmt.Sprintf("%s has no size", t))
+}
+
+// AlignOf returns the ABI alignment of t in bytes.
+func (dl *DataLayout) AlignOf(t types.Type) uint64 {
+	switch t := t.(type) {
+	case *types.IntType:
+		return lookupAlign(dl.intAlign, t.BitSize, true)
+	case *types.FloatType:
+		return lookupAlign(dl.floatAlign, floatBits(t), false)
+	case *types.PointerType:
+		return dl.PointerAlign
+	case *types.ArrayType:
+		return dl.AlignOf(t.ElemType)
+	case *types.VectorType:
+		return lookupAlign(dl.vectorAlign, t.Len*dl.elemBits(t.ElemType), false)
+	case *types.StructType:
+		if t.Opaque {
+			break
+		}
+		if t.Packed {
+			return 1
+		}
+		align := dl.aggregateAlign
+		for _, field := range t.Fields {
+			if a := dl.AlignOf(field); a > align {
+				align = a
+			}
+		}
+		return align
+	}
+	panic(fmt.Sprintf("%s has no alignment", t))
+}
+
+// OffsetOf returns the offset in bytes of the field i of st.
+func (dl *DataLayout) OffsetOf(st *types.StructType, i int) uint64 {
+	if i < 0 || i >= len(st.Fields) {
+		panic(fmt.Sprintf("field %d out of bounds of %s", i, st))
+	}
+	offset := uint64(0)
+	for j, field := range st.Fields {
+		if !st.Packed {
+			offset = alignTo(offset, dl.AlignOf(field))
+		}
+		if j == i {
+			break
+		}
+		offset += dl.SizeOf(field)
+	}
+	return offset
+}
+
+// Size returns the size of t as an i64 constant. A nil layout gives the
+// target-independent `ptrtoint (T* getelementptr (T, T* null, i32 1) to i64)`
+// instead, which LLVM folds to the size on the target the module is compiled
+// for.
+func (dl *DataLayout) Size(t types.Type) constant.Constant {
+	if dl == nil {
+		end := constant.NewGetElementPtr(t, constant.NewNull(TPtr(t)), CI32(1))
+		return constant.NewPtrToInt(end, TI64)
+	}
+	return CI64(int64(dl.SizeOf(t)))
+}
+
+// Offset returns the offset of the field i of st as an i64 constant, target
+// independent for a nil layout like Size.
+func (dl *DataLayout) Offset(st *types.StructType, i int) constant.Constant {
+	if dl == nil {
+		field := constant.NewGetElementPtr(st, constant.NewNull(TPtr(st)), CI32(0), CI32(int64(i)))
+		return constant.NewPtrToInt(field, TI64)
+	}
+	return CI64(int64(dl.OffsetOf(st, i)))
+}
+
+func (dl *DataLayout) elemBits(t types.Type) uint64 {
+	switch t := t.(type) {
+	case *types.IntType:
+		return t.BitSize
+	case *types.FloatType:
+		return floatBits(t)
+	case *types.PointerType:
+		return dl.PointerSize * 8
+	}
+	panic(fmt.Sprintf("%s is not a vector element type", t))
+}
+
+// lookupAlign returns the alignment of size bits in table. An integer type
+// missing from the table is aligned like the next wider integer type listed,
+// or the widest one; other types are aligned to their size.
+func lookupAlign(table map[uint64]uint64, size uint64, isInt bool) uint64 {
+	if align, ok := table[size]; ok {
+		return align
+	}
+	if isInt {
+		best, widest := uint64(0), uint64(0)
+		for s := range table {
+			if s > size && (best == 0 || s < best) {
+				best = s
+			}
+			if s > widest {
+				widest = s
+			}
+		}
+		if best == 0 {
+			best = widest
+		}
+		return table[best]
+	}
+	align := uint64(1)
+	for align*8 < size {
+		align *= 2
+	}
+	return align
+}
+
+func floatBits(t *types.FloatType) uint64 {
+	switch t.Kind {
+	case types.FloatKindHalf:
+		return 16
+	case types.FloatKindFloat:
+		return 32
+	case types.FloatKindDouble:
+		return 64
+	case types.FloatKindX86_FP80:
+		return 80
+	}
+	return 128
+}
+
+func alignTo(n, align uint64) uint64 {
+	return (n + align - 1) / align * align
+}
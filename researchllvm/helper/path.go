@@ -0,0 +1,140 @@
+package helper
+
+import (
+	"fmt"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+)
+
+// Path is a path of fields and indices into the aggregate a pointer points
+// to, or into an aggregate value held in a register. The types along the path
+// are inferred from the start, so
+//
+//	PathOf(b, g).Index(CI32(0)).Addr()
+//
+// is `getelementptr [15 x i8], [15 x i8]* %g, i32 0, i32 0` for a global
+// `[15 x i8]` g. A path from a pointer ends in a single getelementptr, a path
+// from a value in an extractvalue or insertvalue.
+//
+// Each step returns a new path, a path can be shared as the prefix of others.
+type Path struct {
+	b    *ir.Block
+	base value.Value
+	// elem is the element type of the pointer, nil for a value
+	elem types.Type
+	typ  types.Type
+	// getelementptr indices from a pointer, extractvalue indices from a value
+	indices []value.Value
+	consts  []uint64
+}
+
+// PathOf starts a path at the pointee of the pointer v, or at the aggregate
+// value v.
+func PathOf(b *ir.Block, v value.Value) Path {
+	if t, ok := v.Type().(*types.PointerType); ok {
+		return Path{b: b, base: v, elem: t.ElemType, typ: t.ElemType, indices: []value.Value{CI32(0)}}
+	}
+	return Path{b: b, base: v, typ: v.Type()}
+}
+
+// Type is the type at the end of the path.
+func (p Path) Type() types.Type {
+	return p.typ
+}
+
+// Field steps into a struct field, given by index or by name (see NewStruct)
+// for structs defined in the module of the block.
+func (p Path) Field(field interface{}) Path {
+	st, ok := p.typ.(*types.StructType)
+	if !ok {
+		panic(fmt.Sprintf("field of %s, which is not a struct", p.typ))
+	}
+	var i int
+	switch field := field.(type) {
+	case string:
+		var mod *ir.Module
+		if p.b.Parent != nil {
+			mod = p.b.Parent.Parent
+		}
+		s := StructOf(mod, st)
+		if s == nil {
+			panic(fmt.Sprintf("field `%s` of %s, which has no named fields", field, st))
+		}
+		i = s.Index(field)
+	case int:
+		if field < 0 || field >= len(st.Fields) {
+			panic(fmt.Sprintf("field %d out of bounds of %s", field, st))
+		}
+		i = field
+	default:
+		panic(fmt.Sprintf("field must be a name or an index, not %T", field))
+	}
+	// struct indices of getelementptr are i32 constants
+	return p.step(st.Fields[i], CI32(int64(i)), uint64(i))
+}
+
+// Index steps into an array element. A constant index is checked against the
+// length of the array, a path from a value takes constant indices only.
+func (p Path) Index(idx value.Value) Path {
+	arr, ok := p.typ.(*types.ArrayType)
+	if !ok {
+		panic(fmt.Sprintf("index of %s, which is not an array", p.typ))
+	}
+	c, isConst := idx.(*constant.Int)
+	if isConst && (c.X.Sign() < 0 || c.X.Uint64() >= arr.Len) {
+		panic(fmt.Sprintf("index %s out of bounds of %s", c.X, arr))
+	}
+	if p.elem == nil {
+		if !isConst {
+			panic(fmt.Sprintf("index of the value %s must be constant", arr))
+		}
+		return p.step(arr.ElemType, nil, c.X.Uint64())
+	}
+	return p.step(arr.ElemType, idx, 0)
+}
+
+func (p Path) step(typ types.Type, idx value.Value, i uint64) Path {
+	if p.elem != nil {
+		p.indices = append(p.indices[:len(p.indices):len(p.indices)], idx)
+	} else {
+		p.consts = append(p.consts[:len(p.consts):len(p.consts)], i)
+	}
+	p.typ = typ
+	return p
+}
+
+// Addr returns the address at the end of a path from a pointer.
+func (p Path) Addr() *ir.InstGetElementPtr {
+	if p.elem == nil {
+		panic("address of a path from a value")
+	}
+	return p.b.NewGetElementPtr(p.elem, p.base, p.indices...)
+}
+
+func (p Path) Load() *ir.InstLoad {
+	return p.b.NewLoad(p.typ, p.Addr())
+}
+
+func (p Path) Store(v value.Value) *ir.InstStore {
+	return p.b.NewStore(v, p.Addr())
+}
+
+// Extract returns the element at the end of a path from a value.
+func (p Path) Extract() *ir.InstExtractValue {
+	if p.elem != nil || len(p.consts) == 0 {
+		panic("extractvalue needs a path into a value")
+	}
+	return p.b.NewExtractValue(p.base, p.consts...)
+}
+
+// Insert returns the value the path starts at with the element at its end
+// set to v.
+func (p Path) Insert(v value.Value) *ir.InstInsertValue {
+	if p.elem != nil || len(p.consts) == 0 {
+		panic("insertvalue needs a path into a value")
+	}
+	return p.b.NewInsertValue(p.base, v, p.consts...)
+}
@@ -6,7 +6,7 @@ import (
 )
 
 func PrintfPlugin(mod *ir.Module) *ir.Func {
-	printf := mod.NewFunc("printf", types.I32, ir.NewParam("format", types.NewPointer(types.I8)))
+	printf := Declare(mod, "printf", types.I32, ir.NewParam("format", types.NewPointer(types.I8)))
 	printf.Sig.Variadic = true
 	return printf
 }
@@ -0,0 +1,180 @@
+package helper
+
+import (
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/enum"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+)
+
+// RefCountRuntime allocates objects with a header in front of them, `%rc.header
+// = type { i64, void (i8*)* }`, that holds the reference count and the
+// destructor of the object. The destructor is called with the object when its
+// count drops to zero, right before the object is freed.
+type RefCountRuntime struct {
+	mod    *ir.Module
+	Header *types.StructType
+	// void (i8*)*
+	DtorType *types.PointerType
+	// i8* @rc.alloc(i64 size, void (i8*)* dtor), zeroed with a count of one
+	Alloc *ir.Func
+	// void @rc.retain(i8*), null is ignored
+	Retain *ir.Func
+	// void @rc.release(i8*), null is ignored
+	Release *ir.Func
+}
+
+// RefCountPlugin emits the reference counting runtime into mod, or returns the
+// one mod already has.
+func RefCountPlugin(mod *ir.Module) *RefCountRuntime {
+	rt := &RefCountRuntime{mod: mod}
+	rt.DtorType = TPtr(types.NewFunc(TVoid, TPtr(TI8)))
+	for _, def := range mod.TypeDefs {
+		if st, ok := def.(*types.StructType); ok && def.Name() == "rc.header" {
+			rt.Header = st
+		}
+	}
+	if rt.Header != nil {
+		rt.Alloc = Declare(mod, "rc.alloc", TPtr(TI8))
+		rt.Retain = Declare(mod, "rc.retain", TVoid)
+		rt.Release = Declare(mod, "rc.release", TVoid)
+		return rt
+	}
+	rt.Header = mod.NewTypeDef("rc.header", types.NewStruct(TI64, rt.DtorType)).(*types.StructType)
+	rt.emitAlloc()
+	rt.emitRetain()
+	rt.emitRelease()
+	return rt
+}
+
+// Retain increments the reference count of the object p points to.
+func Retain(b *ir.Block, p value.Value) *ir.InstCall {
+	return b.NewCall(RefCountPlugin(moduleOf(b)).Retain, toBytePtr(b, p))
+}
+
+// Release decrements the reference count of the object p points to, and
+// destroys and frees it at zero.
+func Release(b *ir.Block, p value.Value) *ir.InstCall {
+	return b.NewCall(RefCountPlugin(moduleOf(b)).Release, toBytePtr(b, p))
+}
+
+// WithDestructor sets the destructor of an object allocated with WithGC(
+// GCRefCount).
+func WithDestructor(dtor *ir.Func) HeapOption {
+	return func(hc *heapConfig) {
+		hc.dtor = dtor
+	}
+}
+
+// Destructor returns the destructor of objects of type t, which releases the
+// fields of t that are pointers. It is nil when t has no such field.
+func (rt *RefCountRuntime) Destructor(t types.Type) *ir.Func {
+	st, ok := t.(*types.StructType)
+	if !ok {
+		return nil
+	}
+	var fields []int
+	for i, field := range st.Fields {
+		if _, ok := field.(*types.PointerType); ok {
+			fields = append(fields, i)
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	name := st.Name()
+	if name == "" {
+		name = st.LLString()
+	}
+	name = "rc.dtor." + name
+	for _, f := range rt.mod.Funcs {
+		if f.Name() == name {
+			return f
+		}
+	}
+	p := ir.NewParam("p", TPtr(TI8))
+	dtor := rt.mod.NewFunc(name, TVoid, p)
+	dtor.Linkage = enum.LinkageInternal
+	entry := dtor.NewBlock("")
+	obj := entry.NewBitCast(p, TPtr(st))
+	for _, i := range fields {
+		field := entry.NewGetElementPtr(st, obj, CI32(0), CI32(int64(i)))
+		entry.NewCall(rt.Release, toBytePtr(entry, entry.NewLoad(st.Fields[i], field)))
+	}
+	entry.NewRet(nil)
+	return dtor
+}
+
+// header returns the header of the object p points to.
+func (rt *RefCountRuntime) header(b *ir.Block, p value.Value) value.Value {
+	return b.NewGetElementPtr(rt.Header, b.NewBitCast(p, TPtr(rt.Header)), CI32(-1))
+}
+
+func (rt *RefCountRuntime) emitAlloc() {
+	size, dtor := ir.NewParam("size", TI64), ir.NewParam("dtor", rt.DtorType)
+	rt.Alloc = rt.mod.NewFunc("rc.alloc", TPtr(TI8), size, dtor)
+	malloc := Declare(rt.mod, "malloc", TPtr(TI8), ir.NewParam("size", TI64))
+	memset := Declare(rt.mod, "llvm.memset.p0i8.i64", TVoid,
+		ir.NewParam("dst", TPtr(TI8)),
+		ir.NewParam("val", TI8),
+		ir.NewParam("len", TI64),
+		ir.NewParam("isvolatile", types.I1),
+	)
+
+	entry := rt.Alloc.NewBlock("")
+	// the size of the header on any target
+	total := entry.NewAdd((*DataLayout)(nil).Size(rt.Header), size)
+	raw := entry.NewCall(malloc, total)
+	entry.NewCall(memset, raw, CI8(0), total, constant.False)
+	h := entry.NewBitCast(raw, TPtr(rt.Header))
+	entry.NewStore(CI64(1), entry.NewGetElementPtr(rt.Header, h, CI32(0), CI32(0)))
+	entry.NewStore(dtor, entry.NewGetElementPtr(rt.Header, h, CI32(0), CI32(1)))
+	payload := entry.NewGetElementPtr(rt.Header, h, CI32(1))
+	entry.NewRet(entry.NewBitCast(payload, TPtr(TI8)))
+}
+
+func (rt *RefCountRuntime) emitRetain() {
+	p := ir.NewParam("p", TPtr(TI8))
+	rt.Retain = rt.mod.NewFunc("rc.retain", TVoid, p)
+	entry := rt.Retain.NewBlock("")
+	inc := rt.Retain.NewBlock("inc")
+	done := rt.Retain.NewBlock("done")
+	entry.NewCondBr(entry.NewICmp(enum.IPredEQ, p, constant.NewNull(TPtr(TI8))), done, inc)
+
+	count := inc.NewGetElementPtr(rt.Header, rt.header(inc, p), CI32(0), CI32(0))
+	inc.NewStore(inc.NewAdd(inc.NewLoad(TI64, count), CI64(1)), count)
+	inc.NewBr(done)
+
+	done.NewRet(nil)
+}
+
+func (rt *RefCountRuntime) emitRelease() {
+	p := ir.NewParam("p", TPtr(TI8))
+	rt.Release = rt.mod.NewFunc("rc.release", TVoid, p)
+	free := Declare(rt.mod, "free", TVoid, ir.NewParam("ptr", TPtr(TI8)))
+	entry := rt.Release.NewBlock("")
+	dec := rt.Release.NewBlock("dec")
+	destroy := rt.Release.NewBlock("destroy")
+	callDtor := rt.Release.NewBlock("destroy.dtor")
+	freeB := rt.Release.NewBlock("destroy.free")
+	done := rt.Release.NewBlock("done")
+	entry.NewCondBr(entry.NewICmp(enum.IPredEQ, p, constant.NewNull(TPtr(TI8))), done, dec)
+
+	h := rt.header(dec, p)
+	count := dec.NewGetElementPtr(rt.Header, h, CI32(0), CI32(0))
+	n := dec.NewSub(dec.NewLoad(TI64, count), CI64(1))
+	dec.NewStore(n, count)
+	dec.NewCondBr(dec.NewICmp(enum.IPredEQ, n, CI64(0)), destroy, done)
+
+	dtor := destroy.NewLoad(rt.DtorType, destroy.NewGetElementPtr(rt.Header, h, CI32(0), CI32(1)))
+	destroy.NewCondBr(destroy.NewICmp(enum.IPredEQ, dtor, constant.NewNull(rt.DtorType)), freeB, callDtor)
+
+	callDtor.NewCall(dtor, p)
+	callDtor.NewBr(freeB)
+
+	freeB.NewCall(free, freeB.NewBitCast(h, TPtr(TI8)))
+	freeB.NewBr(done)
+
+	done.NewRet(nil)
+}
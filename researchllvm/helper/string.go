@@ -0,0 +1,180 @@
+package helper
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/constant"
+	"github.com/llir/llvm/ir/enum"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+)
+
+// StringRuntime is a string type that carries its length, `%string = type {
+// i8*, i64 }`, and the runtime functions on it. Strings are immutable: the
+// bytes are not NUL-terminated and may be shared, Substr does not copy.
+type StringRuntime struct {
+	mod *ir.Module
+	Typ *types.StructType
+	// %string @string.concat(%string, %string)
+	Concat *ir.Func
+	// i32 @string.compare(%string, %string), less, equal or greater than zero
+	// like memcmp, a prefix is less than the longer string
+	Compare *ir.Func
+	// %string @string.substr(%string, i64 start, i64 len), clamped to the
+	// string
+	Substr *ir.Func
+	// void @string.print(%string)
+	Print *ir.Func
+}
+
+// StringPlugin emits the string runtime into mod, or returns the one mod
+// already has. It panics when mod has a type named `string` that is not the
+// string type of the runtime.
+func StringPlugin(mod *ir.Module) *StringRuntime {
+	rt := &StringRuntime{mod: mod}
+	typ := types.NewStruct(TPtr(TI8), TI64)
+	for _, def := range mod.TypeDefs {
+		if def.Name() != "string" {
+			continue
+		}
+		// named structs are equal by name, compare the fields of the body
+		st, ok := def.(*types.StructType)
+		if !ok || !typ.Equal(&types.StructType{Packed: st.Packed, Fields: st.Fields}) {
+			panic(fmt.Sprintf("type %%string = %s is not the string runtime type %s", def.LLString(), typ.LLString()))
+		}
+		rt.Typ = st
+	}
+	if rt.Typ != nil {
+		// the functions are defined with the type, or by another module that
+		// this one is linked with
+		rt.Concat = Declare(mod, "string.concat", rt.Typ, ir.NewParam("a", rt.Typ), ir.NewParam("b", rt.Typ))
+		rt.Compare = Declare(mod, "string.compare", TI32, ir.NewParam("a", rt.Typ), ir.NewParam("b", rt.Typ))
+		rt.Substr = Declare(mod, "string.substr", rt.Typ,
+			ir.NewParam("s", rt.Typ),
+			ir.NewParam("start", TI64),
+			ir.NewParam("len", TI64),
+		)
+		rt.Print = Declare(mod, "string.print", TVoid, ir.NewParam("s", rt.Typ))
+		return rt
+	}
+	rt.Typ = mod.NewTypeDef("string", typ).(*types.StructType)
+	rt.emitConcat()
+	rt.emitCompare()
+	rt.emitSubstr()
+	rt.emitPrint()
+	return rt
+}
+
+// Literal returns the string constant of text. The bytes are interned into a
+// private constant global, shared by equal literals of the module.
+func (rt *StringRuntime) Literal(text string) constant.Constant {
+	var g *ir.Global
+	n := 0
+	for _, global := range rt.mod.Globals {
+		arr, ok := global.Init.(*constant.CharArray)
+		if !ok || !strings.HasPrefix(global.Name(), ".str") {
+			continue
+		}
+		if string(arr.X) == text {
+			g = global
+			break
+		}
+		n++
+	}
+	if g == nil {
+		name := ".str"
+		if n > 0 {
+			name = fmt.Sprintf(".str.%d", n)
+		}
+		g = rt.mod.NewGlobalDef(name, constant.NewCharArrayFromString(text))
+		g.Linkage = enum.LinkagePrivate
+		g.UnnamedAddr = enum.UnnamedAddrUnnamedAddr
+		g.Immutable = true
+	}
+	ptr := constant.NewGetElementPtr(g.ContentType, g, CI32(0), CI32(0))
+	return constant.NewStruct(rt.Typ, ptr, CI64(int64(len(text))))
+}
+
+func (rt *StringRuntime) newString(b *ir.Block, ptr, length value.Value) value.Value {
+	s := b.NewInsertValue(constant.NewUndef(rt.Typ), ptr, 0)
+	return b.NewInsertValue(s, length, 1)
+}
+
+func (rt *StringRuntime) memcpy() *ir.Func {
+	return Declare(rt.mod, "llvm.memcpy.p0i8.p0i8.i64", TVoid,
+		ir.NewParam("dst", TPtr(TI8)),
+		ir.NewParam("src", TPtr(TI8)),
+		ir.NewParam("len", TI64),
+		ir.NewParam("isvolatile", types.I1),
+	)
+}
+
+func (rt *StringRuntime) emitConcat() {
+	a, b := ir.NewParam("a", rt.Typ), ir.NewParam("b", rt.Typ)
+	rt.Concat = rt.mod.NewFunc("string.concat", rt.Typ, a, b)
+	malloc := Declare(rt.mod, "malloc", TPtr(TI8), ir.NewParam("size", TI64))
+	memcpy := rt.memcpy()
+
+	entry := rt.Concat.NewBlock("")
+	aPtr, aLen := entry.NewExtractValue(a, 0), entry.NewExtractValue(a, 1)
+	bPtr, bLen := entry.NewExtractValue(b, 0), entry.NewExtractValue(b, 1)
+	length := entry.NewAdd(aLen, bLen)
+	buf := entry.NewCall(malloc, length)
+	entry.NewCall(memcpy, buf, aPtr, aLen, constant.False)
+	entry.NewCall(memcpy, entry.NewGetElementPtr(TI8, buf, aLen), bPtr, bLen, constant.False)
+	entry.NewRet(rt.newString(entry, buf, length))
+}
+
+func (rt *StringRuntime) emitCompare() {
+	a, b := ir.NewParam("a", rt.Typ), ir.NewParam("b", rt.Typ)
+	rt.Compare = rt.mod.NewFunc("string.compare", TI32, a, b)
+	memcmp := Declare(rt.mod, "memcmp", TI32,
+		ir.NewParam("s1", TPtr(TI8)),
+		ir.NewParam("s2", TPtr(TI8)),
+		ir.NewParam("n", TI64),
+	)
+
+	entry := rt.Compare.NewBlock("")
+	aLen, bLen := entry.NewExtractValue(a, 1), entry.NewExtractValue(b, 1)
+	shorter := entry.NewSelect(entry.NewICmp(enum.IPredULT, aLen, bLen), aLen, bLen)
+	cmp := entry.NewCall(memcmp, entry.NewExtractValue(a, 0), entry.NewExtractValue(b, 0), shorter)
+	differ := rt.Compare.NewBlock("differ")
+	byLength := rt.Compare.NewBlock("by.length")
+	entry.NewCondBr(entry.NewICmp(enum.IPredNE, cmp, CI32(0)), differ, byLength)
+	differ.NewRet(cmp)
+	longer := byLength.NewZExt(byLength.NewICmp(enum.IPredUGT, aLen, bLen), TI32)
+	less := byLength.NewZExt(byLength.NewICmp(enum.IPredULT, aLen, bLen), TI32)
+	byLength.NewRet(byLength.NewSub(longer, less))
+}
+
+func (rt *StringRuntime) emitSubstr() {
+	s := ir.NewParam("s", rt.Typ)
+	start, length := ir.NewParam("start", TI64), ir.NewParam("len", TI64)
+	rt.Substr = rt.mod.NewFunc("string.substr", rt.Typ, s, start, length)
+
+	entry := rt.Substr.NewBlock("")
+	sLen := entry.NewExtractValue(s, 1)
+	start2 := entry.NewSelect(entry.NewICmp(enum.IPredULT, start, sLen), start, sLen)
+	rest := entry.NewSub(sLen, start2)
+	length2 := entry.NewSelect(entry.NewICmp(enum.IPredULT, length, rest), length, rest)
+	ptr := entry.NewGetElementPtr(TI8, entry.NewExtractValue(s, 0), start2)
+	entry.NewRet(rt.newString(entry, ptr, length2))
+}
+
+func (rt *StringRuntime) emitPrint() {
+	s := ir.NewParam("s", rt.Typ)
+	rt.Print = rt.mod.NewFunc("string.print", TVoid, s)
+	printf := Declare(rt.mod, "printf", TI32, ir.NewParam("format", TPtr(TI8)))
+	printf.Sig.Variadic = true
+	format := rt.mod.NewGlobalDef("string.print.format", constant.NewCharArrayFromString("%.*s\x00"))
+	format.Linkage = enum.LinkagePrivate
+	format.Immutable = true
+
+	entry := rt.Print.NewBlock("")
+	formatPtr := constant.NewGetElementPtr(format.ContentType, format, CI32(0), CI32(0))
+	length := entry.NewTrunc(entry.NewExtractValue(s, 1), TI32)
+	entry.NewCall(printf, formatPtr, length, entry.NewExtractValue(s, 0))
+	entry.NewRet(nil)
+}
@@ -0,0 +1,107 @@
+package helper
+
+import (
+	"fmt"
+
+	"github.com/llir/llvm/ir"
+	"github.com/llir/llvm/ir/metadata"
+	"github.com/llir/llvm/ir/types"
+	"github.com/llir/llvm/ir/value"
+)
+
+type Field struct {
+	Name string
+	Typ  types.Type
+}
+
+// Struct is a struct type with named fields. Code refers to fields by name
+// and the indices follow when a field is inserted.
+type Struct struct {
+	Typ    *types.StructType
+	Fields []Field
+	index  map[string]int
+}
+
+// NewStruct returns the struct type of fields, defined as %name in mod. The
+// field names are kept in mod as the named metadata `!struct.name`, where
+// StructOf finds them. Without module or name, the struct type is a literal
+// type and its field names are only known to the returned Struct.
+func NewStruct(mod *ir.Module, name string, fields ...Field) *Struct {
+	fieldTypes := make([]types.Type, len(fields))
+	for i, field := range fields {
+		fieldTypes[i] = field.Typ
+	}
+	s := newStruct(types.NewStruct(fieldTypes...), fields)
+	if mod != nil && name != "" {
+		mod.NewTypeDef(name, s.Typ)
+		names := &metadata.Tuple{MetadataID: -1}
+		for _, field := range fields {
+			names.Fields = append(names.Fields, &metadata.String{Value: field.Name})
+		}
+		if mod.NamedMetadataDefs == nil {
+			mod.NamedMetadataDefs = make(map[string]*metadata.NamedDef)
+		}
+		mod.MetadataDefs = append(mod.MetadataDefs, names)
+		def := &metadata.NamedDef{Name: "struct." + name, Nodes: []metadata.Node{names}}
+		mod.NamedMetadataDefs[def.Name] = def
+	}
+	return s
+}
+
+func newStruct(typ *types.StructType, fields []Field) *Struct {
+	s := &Struct{Typ: typ, Fields: fields, index: map[string]int{}}
+	for i, field := range fields {
+		if _, dup := s.index[field.Name]; dup {
+			panic(fmt.Sprintf("duplicate field `%s`", field.Name))
+		}
+		s.index[field.Name] = i
+	}
+	return s
+}
+
+// StructOf returns the named-field struct of t, nil when t was not defined in
+// mod by NewStruct.
+func StructOf(mod *ir.Module, t types.Type) *Struct {
+	st, ok := t.(*types.StructType)
+	if !ok || st.TypeName == "" || mod == nil {
+		return nil
+	}
+	def, ok := mod.NamedMetadataDefs["struct."+st.TypeName]
+	if !ok {
+		return nil
+	}
+	names := def.Nodes[0].(*metadata.Tuple)
+	fields := make([]Field, len(st.Fields))
+	for i, name := range names.Fields {
+		fields[i] = Field{Name: name.(*metadata.String).Value, Typ: st.Fields[i]}
+	}
+	return newStruct(st, fields)
+}
+
+// Index returns the index of the field name.
+func (s *Struct) Index(name string) int {
+	i, ok := s.index[name]
+	if !ok {
+		panic(fmt.Sprintf("%s has no field `%s`", s.Typ, name))
+	}
+	return i
+}
+
+func (s *Struct) FieldType(name string) types.Type {
+	return s.Fields[s.Index(name)].Typ
+}
+
+// GEP returns the address of the field name of the struct ptr points to.
+func (s *Struct) GEP(b *ir.Block, ptr value.Value, name string) *ir.InstGetElementPtr {
+	return b.NewGetElementPtr(s.Typ, ptr, CI32(0), CI32(int64(s.Index(name))))
+}
+
+// Extract returns the field name of the struct value v.
+func (s *Struct) Extract(b *ir.Block, v value.Value, name string) *ir.InstExtractValue {
+	return b.NewExtractValue(v, uint64(s.Index(name)))
+}
+
+// Insert returns the struct value v with its field name set to elem.
+func (s *Struct) Insert(b *ir.Block, v, elem value.Value, name string) *ir.InstInsertValue {
+	return b.NewInsertValue(v, elem, uint64(s.Index(name)))
+}
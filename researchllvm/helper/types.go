@@ -5,10 +5,31 @@ import "github.com/llir/llvm/ir/types"
 var (
 	TVoid = types.Void
 	TI8   = types.I8
+	TI16  = types.I16
 	TI32  = types.I32
 	TI64  = types.I64
 )
 
+// Unsigned integer types. LLVM has no signedness in types, they are printed as
+// plain iN; compilers tell them apart from TI8, TI16, ... by identity, see
+// IsUnsigned. Instructions created from a value keep its type, so the
+// signedness follows the value through the IR.
+var (
+	TU8  = &types.IntType{BitSize: 8}
+	TU16 = &types.IntType{BitSize: 16}
+	TU32 = &types.IntType{BitSize: 32}
+	TU64 = &types.IntType{BitSize: 64}
+)
+
+// IsUnsigned reports whether t is one of the unsigned integer types, or i1.
+func IsUnsigned(t types.Type) bool {
+	switch t {
+	case TU8, TU16, TU32, TU64, types.I1:
+		return true
+	}
+	return false
+}
+
 func TPtr(t types.Type) *types.PointerType {
 	return types.NewPointer(t)
 }
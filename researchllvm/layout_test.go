@@ -0,0 +1,53 @@
+package researchllvm
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/llir/llvm/ir/types"
+	. "github.com/llir/researchllvm/helper"
+)
+
+func TestDataLayout(t *testing.T) {
+	foo := types.NewStruct(types.I8, types.I64, types.I16)
+	for _, test := range []struct {
+		dl                 *DataLayout
+		size, align, field uint64
+	}{
+		// i64 is aligned to 8 bytes on x86-64
+		{dl: X86_64, size: 24, align: 8, field: 8},
+		// and to 4 bytes on i386
+		{dl: I386, size: 16, align: 4, field: 4},
+	} {
+		if size := test.dl.SizeOf(foo); size != test.size {
+			t.Errorf("size of %s: expected %d, got %d", foo, test.size, size)
+		}
+		if align := test.dl.AlignOf(foo); align != test.align {
+			t.Errorf("alignment of %s: expected %d, got %d", foo, test.align, align)
+		}
+		if offset := test.dl.OffsetOf(foo, 1); offset != test.field {
+			t.Errorf("offset of field 1 of %s: expected %d, got %d", foo, test.field, offset)
+		}
+	}
+	if size := X86_64.SizeOf(types.NewPointer(foo)); size != 8 {
+		t.Errorf("size of a pointer on x86-64: expected 8, got %d", size)
+	}
+	if size := I386.SizeOf(types.X86_FP80); size != 12 {
+		t.Errorf("size of x86_fp80 on i386: expected 12, got %d", size)
+	}
+	// an aggregate ABI alignment of 0 means 1
+	empty := types.NewStruct()
+	if align := NewDataLayout("e-a:0:64").AlignOf(empty); align != 1 {
+		t.Errorf("alignment of %s with a:0:64: expected 1, got %d", empty, align)
+	}
+	if size := NewDataLayout("e-a:0:64").SizeOf(types.NewStruct(empty, types.I8)); size != 1 {
+		t.Errorf("size of a struct of %s and i8 with a:0:64: expected 1, got %d", empty, size)
+	}
+
+	var portable *DataLayout
+	fmt.Println(portable.Size(foo))
+}
+
+// Output:
+//
+// i64 ptrtoint ({ i8, i64, i16 }* getelementptr ({ i8, i64, i16 }, { i8, i64, i16 }* null, i32 1) to i64)
@@ -10,6 +10,7 @@ import (
 
 func TestMalloc(t *testing.T) {
 	mod := ir.NewModule()
+	mod.DataLayout = X86_64.String()
 
 	structType := mod.NewTypeDef(
 		"foo",
@@ -19,34 +20,46 @@ func TestMalloc(t *testing.T) {
 		),
 	)
 
-	mallocFunc := mod.NewFunc("malloc",
-		types.NewPointer(types.I8),
-		ir.NewParam("", types.I64),
-	)
-
 	main := mod.NewFunc(
 		"main",
 		types.I32,
 	)
 	block := main.NewBlock("")
-	mallocatedSpaceRaw := block.NewCall(mallocFunc, CI64(128))
-	block.NewBitCast(mallocatedSpaceRaw, types.NewPointer(structType))
+	foo := NewHeap(block, structType)
+	foos := NewHeapArray(block, structType, CI32(4), Zeroed())
+	Free(block, foos)
+	Free(block, foo)
 	block.NewRet(CI32(0))
 
 	PrettyPrint(mod)
+
+	ExecuteIR(mod)
 }
 
 // generated LLVM IR:
 //
 // ```
+// target datalayout = "e-m:e-p270:32:32-p271:32:32-p272:64:64-i64:64-f80:128-n8:16:32:64-S128"
+//
 // %foo = type { i8*, i64 }
 //
-// declare i8* @malloc(i64)
+// declare i8* @malloc(i64 %size)
+//
+// declare void @llvm.memset.p0i8.i64(i8* %dst, i8 %val, i64 %len, i1 %isvolatile)
+//
+// declare void @free(i8* %ptr)
 //
 // define i32 @main() {
 // ; <label>:0
-// 	%1 = call i8* @malloc(i64 128)
+// 	%1 = call i8* @malloc(i64 16)
 // 	%2 = bitcast i8* %1 to %foo*
+// 	%3 = call i8* @malloc(i64 64)
+// 	call void @llvm.memset.p0i8.i64(i8* %3, i8 0, i64 64, i1 false)
+// 	%4 = bitcast i8* %3 to %foo*
+// 	%5 = bitcast %foo* %4 to i8*
+// 	call void @free(i8* %5)
+// 	%6 = bitcast %foo* %2 to i8*
+// 	call void @free(i8* %6)
 // 	ret i32 0
 // }
 // ```
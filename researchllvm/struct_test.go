@@ -12,11 +12,8 @@ import (
 func TestStruct(t *testing.T) {
 	mod := ir.NewModule()
 
-	stringTyp := mod.NewTypeDef(
-		"string",
-		types.NewStruct(
-			types.NewPointer(types.I8),
-		),
+	stringTyp := NewStruct(mod, "string",
+		Field{Name: "cstring", Typ: types.NewPointer(types.I8)},
 	)
 
 	printf := PrintfPlugin(mod)
@@ -27,17 +24,9 @@ func TestStruct(t *testing.T) {
 		types.I32,
 	)
 	mainB := main.NewBlock("")
-	ptrToStr := mainB.NewGetElementPtr(
-		types.NewArray(15, types.I8), helloWorldString,
-		CI32(0),
-		CI32(0),
-	)
-	s := mainB.NewAlloca(stringTyp)
-	sFieldCstring := mainB.NewGetElementPtr(
-		stringTyp, s,
-		CI32(0),
-		CI32(0),
-	)
+	ptrToStr := PathOf(mainB, helloWorldString).Index(CI32(0)).Addr()
+	s := mainB.NewAlloca(stringTyp.Typ)
+	sFieldCstring := stringTyp.GEP(mainB, s, "cstring")
 	mainB.NewStore(ptrToStr, sFieldCstring)
 	mainB.NewCall(printf, mainB.NewLoad(types.NewPointer(types.I8), sFieldCstring))
 	mainB.NewRet(CI32(0))